@@ -0,0 +1,276 @@
+//libconf：配置检查工具，用于部署流水线
+//  libconf dump -config ./conf/dev/              打印解析后的完整配置，密码等已脱敏
+//  libconf diff ./conf/dev/ ./conf/prod/         按key对比两个环境的配置，存在差异时退出码为1，密码不同时只提示存在差异
+//  libconf validate -config ./conf/dev/          按BaseConf、MysqlMapConf、RedisMapConf校验配置，存在错误时退出码为1
+//dump、validate支持 -set key=value 覆盖配置，只对本次命令生效，环境变量覆盖见tool.ConfEnvPrefix
+//配置目录也可以作为第一个参数，如 libconf validate ./conf/dev/ -set key=value
+//配置无法加载时退出码为2
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"lib/tool"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	exitOK      = 0
+	exitFailed  = 1 //校验失败或存在差异
+	exitUsage   = 2 //参数错误或配置无法加载
+	usageString = `usage:
+  libconf dump -config ./conf/dev/ [-set key=value]
+  libconf diff ./conf/dev/ ./conf/prod/
+  libconf validate -config ./conf/dev/ [-set key=value]
+`
+)
+
+//可重复的 -set key=value
+type setFlags []string
+
+func (s *setFlags) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *setFlags) Set(value string) error {
+	idx := strings.Index(value, "=")
+	if idx <= 0 {
+		return fmt.Errorf("invalid -set %q, such as : -set mysql_map.list.default.max_open_conn=50", value)
+	}
+	*s = append(*s, value)
+	return nil
+}
+
+//参数全部解析成功后再设置配置覆盖
+func (s *setFlags) apply() error {
+	for _, value := range *s {
+		idx := strings.Index(value, "=")
+		if err := tool.SetConfOverride(value[:idx], value[idx+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usageString)
+		os.Exit(exitUsage)
+	}
+	var code int
+	switch os.Args[1] {
+	case "dump":
+		code = runDump(os.Args[2:])
+	case "diff":
+		code = runDiff(os.Args[2:])
+	case "validate":
+		code = runValidate(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usageString)
+		code = exitUsage
+	}
+	os.Exit(code)
+}
+
+//解析 -config、-set 参数
+func parseFlags(name string, args []string) (string, bool) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	conf := fs.String("config", "", "input config dir ,such as : ./conf/dev/")
+	sets := setFlags{}
+	fs.Var(&sets, "set", "override config, such as : mysql_map.list.default.max_open_conn=50")
+	if err := fs.Parse(args); err != nil {
+		return "", false
+	}
+	//flag在第一个非flag参数处停止解析，继续解析配置目录之后的参数
+	if *conf == "" && fs.NArg() > 0 {
+		*conf = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return "", false
+		}
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		fmt.Fprint(os.Stderr, usageString)
+		return "", false
+	}
+	if *conf == "" {
+		fmt.Fprint(os.Stderr, usageString)
+		return "", false
+	}
+	if err := sets.apply(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return "", false
+	}
+	return *conf, true
+}
+
+//加载环境目录下的全部配置
+func loadConf(path string) error {
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	if err := tool.ParseConfPath(path); err != nil {
+		return err
+	}
+	return tool.InitViperConf()
+}
+
+//将配置展开为 文件名.key -> 值，输出前需要通过redactValue脱敏
+func flattenConf() map[string]interface{} {
+	res := map[string]interface{}{}
+	for name, v := range tool.ViperConfMap {
+		flattenValue(res, name, v.AllSettings())
+	}
+	return res
+}
+
+func flattenValue(res map[string]interface{}, prefix string, val interface{}) {
+	if m, ok := val.(map[string]interface{}); ok {
+		for k, item := range m {
+			flattenValue(res, prefix+"."+k, item)
+		}
+		return
+	}
+	res[prefix] = val
+}
+
+//按展开后key的最后一级脱敏
+func redactValue(key string, val interface{}) string {
+	return formatValue(tool.RedactConf(key[strings.LastIndex(key, ".")+1:], val))
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(val interface{}) string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(val); err != nil {
+		return fmt.Sprintf("%v", val)
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+func runDump(args []string) int {
+	defer tool.ClearConfOverrides()
+	conf, ok := parseFlags("dump", args)
+	if !ok {
+		return exitUsage
+	}
+	if err := loadConf(conf); err != nil {
+		fmt.Fprintln(os.Stderr, "load config failed:", err)
+		return exitUsage
+	}
+	flat := flattenConf()
+	for _, k := range sortedKeys(flat) {
+		fmt.Printf("%s = %s\n", k, redactValue(k, flat[k]))
+	}
+	return exitOK
+}
+
+func runDiff(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, usageString)
+		return exitUsage
+	}
+	envs := make([]map[string]interface{}, 2)
+	for i, conf := range args {
+		if err := loadConf(conf); err != nil {
+			fmt.Fprintln(os.Stderr, "load config failed:", err)
+			return exitUsage
+		}
+		envs[i] = flattenConf()
+	}
+	all := map[string]interface{}{}
+	for _, env := range envs {
+		for k := range env {
+			all[k] = nil
+		}
+	}
+	diff := 0
+	for _, k := range sortedKeys(all) {
+		a, inA := envs[0][k]
+		b, inB := envs[1][k]
+		switch {
+		case !inB:
+			fmt.Printf("- %s = %s\n", k, redactValue(k, a))
+		case !inA:
+			fmt.Printf("+ %s = %s\n", k, redactValue(k, b))
+		case formatValue(a) == formatValue(b):
+			continue
+		case redactValue(k, a) == redactValue(k, b):
+			//只有密码不同，不打印密码
+			fmt.Printf("~ %s = <redacted, differs>\n", k)
+		default:
+			fmt.Printf("~ %s = %s -> %s\n", k, redactValue(k, a), redactValue(k, b))
+		}
+		diff++
+	}
+	if diff > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+func runValidate(args []string) int {
+	defer tool.ClearConfOverrides()
+	conf, ok := parseFlags("validate", args)
+	if !ok {
+		return exitUsage
+	}
+	//未使用的key、结构体标签错误均视为错误
+	tool.ConfStrictMode = tool.ConfStrictError
+	if err := loadConf(conf); err != nil {
+		fmt.Fprintln(os.Stderr, "load config failed:", err)
+		return exitUsage
+	}
+	errs := []string{}
+	check := func(file string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", file, err))
+		}
+	}
+
+	if tool.ViperConfMap["base"] != nil {
+		check("base", tool.BindConf("base", &tool.BaseConf{}))
+		if err := tool.LoadBaseConf(tool.GetConfPath("base")); err != nil {
+			check("base", err)
+		} else if _, err := time.LoadLocation(tool.ConfBase.TimeLocation); err != nil {
+			check("base", fmt.Errorf("invalid time_location %q: %v", tool.ConfBase.TimeLocation, err))
+		}
+	}
+	if tool.ViperConfMap["mysql_map"] != nil {
+		check("mysql_map", tool.BindConf("mysql_map", &tool.MysqlMapConf{}))
+	}
+	if tool.ViperConfMap["redis_map"] != nil {
+		redisConf := &tool.RedisMapConf{}
+		if err := tool.BindConf("redis_map", redisConf); err != nil {
+			check("redis_map", err)
+		} else {
+			for name, cfg := range redisConf.List {
+				check("redis_map", tool.ValidateRedisConf(name, cfg))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return exitFailed
+	}
+	fmt.Println("config ok:", conf)
+	return exitOK
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lib/tool"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//在临时目录下生成配置，files为文件名 -> 内容
+func writeConfDir(t *testing.T, root string, env string, files map[string]string) string {
+	dir := filepath.Join(root, env)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir + "/"
+}
+
+//执行fn并返回其标准输出
+func captureStdout(t *testing.T, fn func() int) (int, string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	code := fn()
+	os.Stdout = stdout
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	return code, string(out)
+}
+
+func TestLibconf(t *testing.T) {
+	root, err := ioutil.TempDir("", "libconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	oldStrict := tool.ConfStrictMode
+	defer func() { tool.ConfStrictMode = oldStrict }()
+
+	base := "[base]\ndebug_mode=\"debug\"\ntime_location=\"UTC\"\n"
+	dev := writeConfDir(t, root, "dev", map[string]string{"base.toml": base})
+	prod := writeConfDir(t, root, "prod", map[string]string{"base.toml": strings.Replace(base, "debug\"", "release\"", 1)})
+	broken := writeConfDir(t, root, "broken", map[string]string{"base.toml": "[base\n"})
+	unknown := writeConfDir(t, root, "unknown", map[string]string{"base.toml": base + "unknown_key=1\n"})
+	mysql := "[list.default]\ndata_source_name=\"root:%s@tcp(127.0.0.1:3306)/test\"\n"
+	dbA := writeConfDir(t, root, "db_a", map[string]string{"mysql_map.toml": fmt.Sprintf(mysql, "pass-a")})
+	dbB := writeConfDir(t, root, "db_b", map[string]string{"mysql_map.toml": fmt.Sprintf(mysql, "pass-b")})
+
+	for _, tc := range []struct {
+		name   string
+		run    func(args []string) int
+		args   []string
+		code   int
+		output string
+	}{
+		{"dump", runDump, []string{"-config", dev}, exitOK, `base.base.debug_mode = "debug"`},
+		//配置目录之后的 -set 同样生效
+		{"dump positional set", runDump, []string{dev, "-set", "base.base.time_location=Asia/Shanghai"}, exitOK,
+			`base.base.time_location = "Asia/Shanghai"`},
+		//-set只对本次命令生效
+		{"dump after set", runDump, []string{dev}, exitOK, `base.base.time_location = "UTC"`},
+		{"dump extra args", runDump, []string{"-config", dev, "extra"}, exitUsage, ""},
+		{"dump no config", runDump, nil, exitUsage, ""},
+		{"dump broken", runDump, []string{broken}, exitUsage, ""},
+		{"validate", runValidate, []string{dev}, exitOK, "config ok"},
+		{"validate broken", runValidate, []string{broken}, exitUsage, ""},
+		{"validate unknown key", runValidate, []string{unknown}, exitFailed, ""},
+		{"validate extra args", runValidate, []string{dev, "-set", "base.base.debug_mode=release", "extra"}, exitUsage, ""},
+		{"diff", runDiff, []string{dev, prod}, exitFailed, `~ base.base.debug_mode = "debug" -> "release"`},
+		{"diff same", runDiff, []string{dev, dev}, exitOK, ""},
+		{"diff broken", runDiff, []string{dev, broken}, exitUsage, ""},
+		//只有密码不同时提示差异，不打印密码
+		{"diff password", runDiff, []string{dbA, dbB}, exitFailed, "~ mysql_map.list.default.data_source_name = <redacted, differs>"},
+	} {
+		code, out := captureStdout(t, func() int { return tc.run(tc.args) })
+		if strings.Contains(out, "pass-") {
+			t.Errorf("%s: password printed: %s", tc.name, out)
+		}
+		if code != tc.code {
+			t.Errorf("%s: exit code %d, want %d, output %s", tc.name, code, tc.code, out)
+			continue
+		}
+		if !strings.Contains(out, tc.output) {
+			t.Errorf("%s: output %q does not contain %q", tc.name, out, tc.output)
+		}
+	}
+}
@@ -49,7 +49,7 @@ func (f *FileWriter) SetLogLevelCeil(ceil int) {
 	f.logLevelCeil = ceil
 }
 
-//创建日志文件
+//创建日志文件，目录或文件不存在时自动创建，已存在时追加写入
 func (f *FileWriter) CreateLogFile() error {
 	//0755->即用户具有读/写/执行权限，组用户和其它用户具有读写权限
 	if err := os.MkdirAll(path.Dir(f.filename), 0755); err != nil {
@@ -58,9 +58,9 @@ func (f *FileWriter) CreateLogFile() error {
 			return err
 		}
 	}
-	//可对文件进行读写或者追加
+	//可对文件进行读写或者追加，文件不存在时创建
 	//0644->即用户具有读写权限，组用户和其它用户具有只读权限
-	if file, err := os.OpenFile(f.filename, os.O_RDWR|os.O_APPEND, 0644); err != nil {
+	if file, err := os.OpenFile(f.filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644); err != nil {
 		return err
 	} else {
 		f.file = file
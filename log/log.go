@@ -6,7 +6,9 @@ import (
 	"path"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,8 +29,39 @@ const tunnel_size_default = 1024
 var (
 	logger_default *Logger
 	takeup         = false
+	defaultMu      sync.RWMutex //保护logger_default的创建和关闭
 )
 
+//全部logger的累计统计
+var (
+	recordCount  [len(LEVEL_FLAGS)]uint64 //各级别进入tunnel的记录数
+	droppedCount uint64                   //写入writer失败的记录数，每条记录只计一次
+)
+
+//日志统计，用于监控
+type Stats struct {
+	Records map[string]uint64 //按级别（小写）累计的记录数
+	Dropped uint64            //写入任一writer失败的记录数，多个writer失败只计一次，tunnel写满时会阻塞而不会丢弃
+	Queued  int               //默认logger的tunnel中等待写入的记录数
+}
+
+//获取日志统计
+func GetStats() Stats {
+	stats := Stats{
+		Records: make(map[string]uint64, len(LEVEL_FLAGS)),
+		Dropped: atomic.LoadUint64(&droppedCount),
+	}
+	for i, flag := range LEVEL_FLAGS {
+		stats.Records[strings.ToLower(flag)] = atomic.LoadUint64(&recordCount[i])
+	}
+	defaultMu.RLock()
+	if l := logger_default; l != nil {
+		stats.Queued = len(l.tunnel)
+	}
+	defaultMu.RUnlock()
+	return stats
+}
+
 //记录
 type Record struct {
 	time  string
@@ -178,6 +211,7 @@ func (l *Logger) deliverRecordToWriter(level int, format string, args ...interfa
 	r.time = l.lastTimeStr
 	r.level = level
 
+	atomic.AddUint64(&recordCount[level], 1)
 	l.tunnel <- r
 
 }
@@ -193,11 +227,7 @@ func bootstrapLogWriter(logger *Logger) {
 		logger.c <- true
 		return
 	}
-	for _, w := range logger.writers {
-		if err := w.Write(r); err != nil {
-			log.Println(err)
-		}
-	}
+	logger.writeRecord(r)
 
 	flushTimer := time.NewTimer(time.Millisecond * 500)
 	rotateTimer := time.NewTimer(time.Second * 10)
@@ -209,11 +239,7 @@ func bootstrapLogWriter(logger *Logger) {
 				logger.c <- true
 				return
 			}
-			for _, w := range logger.writers {
-				if err := w.Write(r); err != nil {
-					log.Println(err)
-				}
-			}
+			logger.writeRecord(r)
 			logger.recordPool.Put(r)
 		case <-flushTimer.C:
 			for _, w := range logger.writers {
@@ -242,7 +268,23 @@ func bootstrapLogWriter(logger *Logger) {
 	}
 }
 
+//把record写入全部writer，任一writer失败时计入一次droppedCount
+func (l *Logger) writeRecord(r *Record) {
+	failed := false
+	for _, w := range l.writers {
+		if err := w.Write(r); err != nil {
+			failed = true
+			log.Println(err)
+		}
+	}
+	if failed {
+		atomic.AddUint64(&droppedCount, 1)
+	}
+}
+
 func defaultLoggerInit() {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
 	if takeup == false {
 		logger_default = NewLoger()
 	}
@@ -295,7 +337,10 @@ func Register(w Writer) {
 
 func Close() {
 	defaultLoggerInit()
-	logger_default.Close()
+	defaultMu.Lock()
+	l := logger_default
 	logger_default = nil
 	takeup = false
+	defaultMu.Unlock()
+	l.Close()
 }
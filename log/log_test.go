@@ -1,6 +1,11 @@
 package log
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -27,3 +32,63 @@ func TestLogInstance(t *testing.T) {
 	log.Close()
 	time.Sleep(time.Second * 3)
 }
+
+type failWriter struct{}
+
+func (w failWriter) Init() error { return nil }
+
+func (w failWriter) Write(r *Record) error { return errors.New("write failed") }
+
+//同一条记录在多个writer失败只计一次
+func TestStatsDropped(t *testing.T) {
+	l := NewLoger()
+	l.Register(failWriter{})
+	l.Register(failWriter{})
+	before := GetStats().Dropped
+	l.Info("first")
+	l.Info("second")
+	l.Close()
+	if dropped := GetStats().Dropped - before; dropped != 2 {
+		t.Fatalf("dropped %d, want 2", dropped)
+	}
+}
+
+//GetStats与Close并发时不产生数据竞争
+func TestStatsClose(t *testing.T) {
+	Info("default")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			GetStats()
+		}
+	}()
+	Close()
+	<-done
+}
+
+//日志目录和文件不存在时自动创建，已存在时追加
+func TestFileWriterCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "sub", "test.log")
+	for _, info := range []string{"first", "second"} {
+		w := NewFileWriter()
+		w.SetFileName(filename)
+		w.SetLogLevelFloor(TRACE)
+		w.SetLogLevelCeil(FATAL)
+		if err := w.Init(); err != nil {
+			t.Fatal(err)
+		}
+		w.Write(&Record{info: info, level: INFO})
+		w.Flush()
+		w.file.Close()
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil || strings.Count(string(data), "\n") != 2 || !strings.Contains(string(data), "first") {
+		t.Fatalf("unexpected log file %q %v", data, err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"lib/log"
 	"lib/tool"
@@ -11,10 +12,16 @@ func main() {
 	if err := tool.InitModule("./conf/dev/", []string{"base", "mysql", "redis"}); err != nil {
 		log.Fatal(fmt.Sprintf("%s", err))
 	}
-	defer tool.Destroy()
 
-	tool.Log.TagInfo(tool.NewTrace(), tool.DLTagUndefind, map[string]interface{}{
-		"message": "todo something",
-	})
-	time.Sleep(time.Second)
+	//收到SIGINT/SIGTERM后执行关闭钩子并销毁资源
+	err := tool.Run(func(ctx context.Context) error {
+		tool.Log.TagInfo(tool.NewTrace(), tool.DLTagUndefind, map[string]interface{}{
+			"message": "todo something",
+		})
+		<-ctx.Done()
+		return nil
+	}, 10*time.Second)
+	if err != nil {
+		fmt.Println(err)
+	}
 }
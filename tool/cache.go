@@ -0,0 +1,257 @@
+package tool
+
+import (
+	"bytes"
+	"container/list"
+	"github.com/pkg/errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//loader返回该错误表示数据不存在，结果会按NegativeTTL缓存，防止缓存穿透
+var ErrCacheNotFound = errors.New("cache: not found")
+
+//redis中表示"数据不存在"的占位值
+var cacheNilValue = []byte("\x00lib-cache-nil\x00")
+
+const (
+	cacheNegativeTTLDefault = time.Minute
+	cacheJitterDefault      = 0.1
+)
+
+type CacheOptions struct {
+	Prefix      string        //redis key前缀
+	LocalSize   int           //本地LRU容量，0为不使用本地缓存
+	LocalTTL    time.Duration //本地缓存时间，0时与redis的ttl一致
+	NegativeTTL time.Duration //数据不存在时的缓存时间，默认1分钟
+	Jitter      float64       //ttl随机增加的比例，默认0.1，负数为关闭
+	Codec       RedisCodec    //GetOrLoadObject使用的编解码，默认RedisDefaultCodec
+}
+
+//cache-aside：本地LRU -> redis -> loader，同一个key的并发未命中只调用一次loader
+type Cache struct {
+	client *RedisClient
+	opts   CacheOptions
+	local  *cacheLRU
+	mu     sync.Mutex
+	calls  map[string]*cacheCall
+}
+
+//正在进行中的加载
+type cacheCall struct {
+	wg  sync.WaitGroup
+	val []byte
+	err error
+}
+
+//按redis配置名生成缓存
+func NewCache(name string, opts CacheOptions) *Cache {
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = cacheNegativeTTLDefault
+	}
+	if opts.Jitter == 0 {
+		opts.Jitter = cacheJitterDefault
+	}
+	if opts.Codec == nil {
+		opts.Codec = RedisDefaultCodec
+	}
+	c := &Cache{
+		client: NewRedisClient(name).WithCodec(opts.Codec),
+		opts:   opts,
+		calls:  map[string]*cacheCall{},
+	}
+	if opts.LocalSize > 0 {
+		c.local = newCacheLRU(opts.LocalSize)
+	}
+	return c
+}
+
+//ttl增加随机抖动，避免同一批key同时过期
+func (c *Cache) jitter(ttl time.Duration) time.Duration {
+	if c.opts.Jitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(rand.Int63n(int64(float64(ttl)*c.opts.Jitter)+1))
+}
+
+func (c *Cache) localTTL(ttl time.Duration) time.Duration {
+	if c.opts.LocalTTL > 0 && c.opts.LocalTTL < ttl {
+		return c.opts.LocalTTL
+	}
+	return ttl
+}
+
+//按key读取缓存，未命中时调用loader加载并回写
+//loader返回ErrCacheNotFound时缓存空结果，其他错误不缓存
+//每个调用方得到各自的副本，修改返回值不影响缓存及其他调用方
+func (c *Cache) GetOrLoad(trace *TraceContext, key string, ttl time.Duration, loader func() ([]byte, error)) ([]byte, error) {
+	if c.local != nil {
+		if val, ok := c.local.Get(key); ok {
+			val, err := cacheResult(val)
+			return cacheCopy(val), err
+		}
+	}
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		return cacheCopy(call.val), call.err
+	}
+	//loader发生panic时等待者得到该错误
+	call := &cacheCall{err: errors.New("cache: loader panicked")}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	call.val, call.err = c.load(trace, key, ttl, loader)
+	return cacheCopy(call.val), call.err
+}
+
+func (c *Cache) load(trace *TraceContext, key string, ttl time.Duration, loader func() ([]byte, error)) ([]byte, error) {
+	redisKey := c.opts.Prefix + key
+	//redis出错时降级为直接调用loader
+	val, err := c.client.GetBytes(trace, redisKey)
+	if err == nil {
+		if c.local != nil {
+			localTTL := c.localTTL(ttl)
+			if bytes.Equal(val, cacheNilValue) {
+				localTTL = c.localTTL(c.opts.NegativeTTL)
+			}
+			c.local.Set(key, val, localTTL)
+		}
+		return cacheResult(val)
+	}
+
+	val, err = loader()
+	if err == ErrCacheNotFound {
+		c.client.Set(trace, redisKey, cacheNilValue, c.jitter(c.opts.NegativeTTL))
+		if c.local != nil {
+			c.local.Set(key, cacheNilValue, c.localTTL(c.opts.NegativeTTL))
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.client.Set(trace, redisKey, val, c.jitter(ttl))
+	if c.local != nil {
+		c.local.Set(key, val, c.localTTL(ttl))
+	}
+	return val, nil
+}
+
+//通过编解码存取结构体，v为接收结果的指针
+func (c *Cache) GetOrLoadObject(trace *TraceContext, key string, ttl time.Duration, v interface{}, loader func() (interface{}, error)) error {
+	val, err := c.GetOrLoad(trace, key, ttl, func() ([]byte, error) {
+		obj, err := loader()
+		if err != nil {
+			return nil, err
+		}
+		return c.opts.Codec.Marshal(obj)
+	})
+	if err != nil {
+		return err
+	}
+	return c.opts.Codec.Unmarshal(val, v)
+}
+
+//删除缓存，数据更新后调用
+func (c *Cache) Del(trace *TraceContext, key string) error {
+	if c.local != nil {
+		c.local.Del(key)
+	}
+	_, err := c.client.Del(trace, c.opts.Prefix+key)
+	return err
+}
+
+func cacheResult(val []byte) ([]byte, error) {
+	if bytes.Equal(val, cacheNilValue) {
+		return nil, ErrCacheNotFound
+	}
+	return val, nil
+}
+
+//本地缓存及并发等待者共享同一个[]byte，返回给调用方前复制
+func cacheCopy(val []byte) []byte {
+	if val == nil {
+		return nil
+	}
+	return append([]byte{}, val...)
+}
+
+//带过期时间的本地LRU
+type cacheLRU struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheLRUEntry struct {
+	key      string
+	val      []byte
+	expireAt time.Time
+}
+
+func newCacheLRU(size int) *cacheLRU {
+	return &cacheLRU{
+		size:  size,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (l *cacheLRU) Get(key string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheLRUEntry)
+	if time.Now().After(entry.expireAt) {
+		l.ll.Remove(e)
+		delete(l.items, key)
+		return nil, false
+	}
+	l.ll.MoveToFront(e)
+	return entry.val, true
+}
+
+func (l *cacheLRU) Set(key string, val []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expireAt := time.Now().Add(ttl)
+	if e, ok := l.items[key]; ok {
+		entry := e.Value.(*cacheLRUEntry)
+		entry.val, entry.expireAt = val, expireAt
+		l.ll.MoveToFront(e)
+		return
+	}
+	l.items[key] = l.ll.PushFront(&cacheLRUEntry{key: key, val: val, expireAt: expireAt})
+	for l.ll.Len() > l.size {
+		e := l.ll.Back()
+		l.ll.Remove(e)
+		delete(l.items, e.Value.(*cacheLRUEntry).key)
+	}
+}
+
+func (l *cacheLRU) Del(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.ll.Remove(e)
+		delete(l.items, key)
+	}
+}
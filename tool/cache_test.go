@@ -0,0 +1,122 @@
+package tool
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//未配置redis时降级为本地缓存+loader
+func TestCacheGetOrLoad(t *testing.T) {
+	cache := NewCache("cache_test_missing", CacheOptions{LocalSize: 10})
+	var calls int32
+	loader := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return []byte("value"), nil
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := cache.GetOrLoad(NewTrace(), "k", time.Minute, loader)
+			if err != nil || string(val) != "value" {
+				t.Errorf("unexpected result %s %v", val, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("concurrent misses should be collapsed, loader called %d times", calls)
+	}
+
+	if _, err := cache.GetOrLoad(NewTrace(), "k", time.Minute, loader); err != nil || calls != 1 {
+		t.Fatalf("expected local hit, loader called %d times, err %v", calls, err)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	cache := NewCache("cache_test_missing", CacheOptions{LocalSize: 10})
+	var calls int32
+	loader := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, ErrCacheNotFound
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cache.GetOrLoad(NewTrace(), "missing", time.Minute, loader); err != ErrCacheNotFound {
+			t.Fatalf("expected ErrCacheNotFound, got %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("negative result should be cached, loader called %d times", calls)
+	}
+}
+
+func TestCacheLRUEvict(t *testing.T) {
+	lru := newCacheLRU(2)
+	lru.Set("a", []byte("1"), time.Minute)
+	lru.Set("b", []byte("2"), time.Minute)
+	lru.Get("a")
+	lru.Set("c", []byte("3"), time.Minute)
+	if _, ok := lru.Get("b"); ok {
+		t.Fatal("least recently used key should be evicted")
+	}
+	if _, ok := lru.Get("a"); !ok {
+		t.Fatal("recently used key should be kept")
+	}
+}
+
+func TestCacheRedis(t *testing.T) {
+	srv, closeFn := withFakeKVRedis(t, "cache_test")
+	defer closeFn()
+	cache := NewCache("cache_test", CacheOptions{Prefix: "c:", LocalSize: 10})
+	var calls int32
+	loader := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return []byte("value"), nil
+	}
+
+	val, err := cache.GetOrLoad(NewTrace(), "k", time.Minute, loader)
+	if err != nil || string(val) != "value" {
+		t.Fatalf("unexpected result %s %v", val, err)
+	}
+	srv.mu.Lock()
+	stored, ok := srv.get("c:k")
+	srv.mu.Unlock()
+	if !ok || stored != "value" {
+		t.Fatalf("value not written to redis, got %q", stored)
+	}
+	//修改返回值不影响本地缓存
+	val[0] = 'X'
+	if val, _ := cache.GetOrLoad(NewTrace(), "k", time.Minute, loader); string(val) != "value" {
+		t.Fatalf("local cache corrupted by caller, got %s", val)
+	}
+
+	//其他实例从redis读取，不调用loader
+	other := NewCache("cache_test", CacheOptions{Prefix: "c:"})
+	if val, err := other.GetOrLoad(NewTrace(), "k", time.Minute, loader); err != nil || string(val) != "value" || calls != 1 {
+		t.Fatalf("expected redis hit, got %s %v, loader called %d times", val, err, calls)
+	}
+
+	//空结果同样写入redis
+	notFound := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, ErrCacheNotFound
+	}
+	if _, err := cache.GetOrLoad(NewTrace(), "missing", time.Minute, notFound); err != ErrCacheNotFound {
+		t.Fatalf("expected ErrCacheNotFound, got %v", err)
+	}
+	if _, err := other.GetOrLoad(NewTrace(), "missing", time.Minute, notFound); err != ErrCacheNotFound || calls != 2 {
+		t.Fatalf("expected cached negative result, got %v, loader called %d times", err, calls)
+	}
+
+	if err := cache.Del(NewTrace(), "k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.GetOrLoad(NewTrace(), "k", time.Minute, loader); err != nil || calls != 3 {
+		t.Fatalf("expected reload after Del, loader called %d times, err %v", calls, err)
+	}
+}
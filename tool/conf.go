@@ -1,20 +1,20 @@
 package tool
 
 import (
-	"bytes"
 	"database/sql"
+	"errors"
 	"github.com/e421083458/gorm"
+	"github.com/gomodule/redigo/redis"
 	"github.com/spf13/viper"
-	"io/ioutil"
 	dlog "lib/log"
-	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 type BaseConf struct {
 	DebugMode    string    `mapstructure:"debug_mode"`
-	TimeLocation string    `mapstructrue:"time_location"` //时区
+	TimeLocation string    `mapstructure:"time_location"` //时区
 	Log          LogConfig `mapstructure:"log"`
 	Base         struct {
 		DebugMode    string `mapstructure:"debug_mode"`
@@ -31,11 +31,11 @@ type LogConfFileWriter struct {
 	LogPath         string `mapstructure:"log_path"`
 	RotateLogPath   string `mapstructure:"rotate_log_path"`
 	WfLogPath       string `mapstructure:"wf_log_path"`
-	RotateWfLogPath string `mapstructure:"rotate_log_path"`
+	RotateWfLogPath string `mapstructure:"rotate_wf_log_path"`
 }
 
 type LogConfig struct {
-	Level string               `mapstructure:"log_level"`
+	Level string               `mapstructure:"log_level" default:"trace" validate:"oneof=trace debug info warning err fatal"`
 	FW    LogConfFileWriter    `mapstructure:"file_writer"`
 	CW    LogConfConsoleWriter `mapstructure:"console_writer"`
 }
@@ -47,12 +47,21 @@ type MysqlMapConf struct {
 }
 
 type MYSQLConf struct {
-	DriverName      string `mapstructure:"driver_name"`        //驱动名称
-	DataSourceName  string `mapstructure:"data_source_name"`   //数据资源名
-	MaxOpenConn     int    `mapstructure:"max_open_conn"`      //最大连接数
-	MaxIdleConn     int    `mapstructure:"max_idle_conn"`      //最大空闲连接
-	MaxConnLifeTime int    `mapstructure:"max_conn_life_time"` //连接最大生存时间
+	DriverName      string `mapstructure:"driver_name"`                          //驱动名称
+	DataSourceName  string `mapstructure:"data_source_name" validate:"required"` //数据资源名
+	MaxOpenConn     int    `mapstructure:"max_open_conn"`                        //最大连接数
+	MaxIdleConn     int    `mapstructure:"max_idle_conn"`                        //最大空闲连接
+	MaxConnLifeTime int    `mapstructure:"max_conn_life_time"`                   //连接最大生存时间
+	SlowThreshold   int    `mapstructure:"slow_threshold"`                       //慢查询阈值（毫秒），超过后打印WARN日志，0为不记录
 
+	Replicas             []*MYSQLReplicaConf `mapstructure:"replicas"`                           //从库，读请求按权重分配到健康的从库
+	MaxReplicaLag        int                 `mapstructure:"max_replica_lag"`                    //从库最大延迟（秒），超过后摘除，0为不检测延迟
+	ReplicaCheckInterval int                 `mapstructure:"replica_check_interval" default:"5"` //从库健康检查间隔（秒）
+}
+
+type MYSQLReplicaConf struct {
+	DataSourceName string `mapstructure:"data_source_name" validate:"required"` //数据资源名，连接数等与主库相同
+	Weight         int    `mapstructure:"weight" default:"1"`                   //权重
 }
 
 //redis
@@ -62,12 +71,23 @@ type RedisMapConf struct {
 }
 
 type RedisConf struct {
-	ProxyList    []string `mapstructure:"proxy_list"`
-	Password     string   `mapstructure:"password"`
-	Db           int      `mapstructure:"db"`
-	ConnTimeout  int      `mapstructure:"conn_timeout"`
-	ReadTimeout  int      `mapstructure:"read_timeout"`
-	WriteTimeout int      `mapstructure:"write_timeout"`
+	Mode             string   `mapstructure:"mode"`              //standalone（默认）、sentinel、cluster
+	ProxyList        []string `mapstructure:"proxy_list"`        //standalone模式的地址列表
+	SentinelList     []string `mapstructure:"sentinel_list"`     //sentinel模式的sentinel地址列表
+	MasterName       string   `mapstructure:"master_name"`       //sentinel模式的主节点名称
+	SentinelPassword string   `mapstructure:"sentinel_password"` //sentinel的密码
+	ClusterList      []string `mapstructure:"cluster_list"`      //cluster模式的种子节点
+	Password         string   `mapstructure:"password"`
+	Db               int      `mapstructure:"db"`
+	ConnTimeout      int      `mapstructure:"conn_timeout"`
+	ReadTimeout      int      `mapstructure:"read_timeout"`
+	WriteTimeout     int      `mapstructure:"write_timeout"`
+	MaxIdle          int      `mapstructure:"max_idle"`           //最大空闲连接
+	MaxActive        int      `mapstructure:"max_active"`         //最大连接数，0为不限制
+	IdleTimeout      int      `mapstructure:"idle_timeout"`       //空闲连接超时时间（秒）
+	Wait             bool     `mapstructure:"wait"`               //连接数达到上限时是否等待
+	TestOnBorrow     int      `mapstructure:"test_on_borrow"`     //空闲超过该秒数的连接取出时先检测，-1为关闭
+	MaxConnLifeTime  int      `mapstructure:"max_conn_life_time"` //连接最大生存时间（秒）
 }
 
 //全局变量
@@ -78,19 +98,31 @@ var DBDefaultPool *sql.DB
 var GORMDefaultPool *gorm.DB
 var ConfRedis *RedisConf
 var ConfRedisMap *RedisMapConf
+var RedisMapPool map[string]*redis.Pool
 var ViperConfMap map[string]*viper.Viper
+var viperConfMu sync.RWMutex //配置热更新时整体替换ViperConfMap
 
 //获取基本配置信息
 func GetBaseConf() *BaseConf {
 	return ConfBase
 }
 
+//加载base配置并初始化日志
 func InitBaseConf(path string) error {
-	ConfBase = &BaseConf{}
-	err := ParseConfig(path, ConfBase)
+	if err := LoadBaseConf(path); err != nil {
+		return err
+	}
+	return InitLog()
+}
+
+//加载base配置并设置默认值
+func LoadBaseConf(path string) error {
+	conf := &BaseConf{}
+	err := ParseConfig(path, conf)
 	if err != nil {
 		return err
 	}
+	ConfBase = conf
 	//debug模式
 	if ConfBase.DebugMode == "" {
 		if ConfBase.Base.DebugMode != "" {
@@ -110,7 +142,14 @@ func InitBaseConf(path string) error {
 	if ConfBase.Log.Level == "" {
 		ConfBase.Log.Level = "trace"
 	}
+	return nil
+}
 
+//按base配置设置日志
+func InitLog() error {
+	if ConfBase == nil {
+		return errors.New("base conf is not loaded")
+	}
 	//配置日志
 	logConf := dlog.LogConfig{
 		Level: ConfBase.Log.Level,
@@ -129,11 +168,10 @@ func InitBaseConf(path string) error {
 
 	//使用配置设置log
 	if err := dlog.SetupDefaultWithConf(logConf); err != nil {
-		panic(err)
+		return err
 	}
 	dlog.SetLayout("2006-01-02T15:04:05.000")
 	return nil
-
 }
 
 func InitRedisConf(path string) error {
@@ -146,125 +184,125 @@ func InitRedisConf(path string) error {
 	return nil
 }
 
-//初始化配置文件
+//初始化配置文件：读取环境目录和公共目录下的全部配置
 func InitViperConf() error {
-	f, err := os.Open(ConfEnvPath + "/")
-	if err != nil {
-		return err
-	}
-	fileList, err := f.Readdir(1024)
+	files, err := confFileList()
 	if err != nil {
 		return err
 	}
 	//将读取到的配置设置到对应类型的ViperConfMap中，例如：mysql_map :viper
-	for _, f0 := range fileList {
-		if !f0.IsDir() {
-			bts, err := ioutil.ReadFile(ConfEnvPath + "/" + f0.Name())
-			if err != nil {
-				return err
-			}
-			v := viper.New()
-			v.SetConfigType("toml")
-			v.ReadConfig(bytes.NewBuffer(bts))
-			pathArr := strings.Split(f0.Name(), ".")
-			if ViperConfMap == nil {
-				ViperConfMap = make(map[string]*viper.Viper)
-			}
-			//mysql_map :viper
-			ViperConfMap[pathArr[0]] = v
+	confMap := make(map[string]*viper.Viper)
+	for name, path := range files {
+		v, err := readConfViper(path)
+		if err != nil {
+			return err
 		}
+		confMap[name] = v
 	}
+	viperConfMu.Lock()
+	ViperConfMap = confMap
+	viperConfMu.Unlock()
 	return nil
 }
 
-//获取配置信息
-func GetConf(key string) interface{} {
+//按"文件名.key"拆分配置key，配置文件不存在或key不完整时返回nil
+func getConfViper(key string) (*viper.Viper, string) {
 	keys := strings.Split(key, ".")
 	if len(keys) < 2 {
+		return nil, ""
+	}
+	v := getViperConf(keys[0])
+	if v == nil {
+		return nil, ""
+	}
+	return v, strings.Join(keys[1:], ".")
+}
+
+//获取配置文件对应的viper，不存在时返回nil
+func getViperConf(file string) *viper.Viper {
+	viperConfMu.RLock()
+	defer viperConfMu.RUnlock()
+	return ViperConfMap[file]
+}
+
+//获取配置信息
+func GetConf(key string) interface{} {
+	v, subKey := getConfViper(key)
+	if v == nil {
 		return nil
 	}
-	v := ViperConfMap[keys[0]]
-	conf := v.Get(strings.Join(keys[1:len(keys)], "."))
-	return conf
+	return v.Get(subKey)
+}
+
+func GetStringConf(key string) string {
+	v, subKey := getConfViper(key)
+	if v == nil {
+		return ""
+	}
+	return v.GetString(subKey)
 }
 
 func GetBoolConf(key string) bool {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	v, subKey := getConfViper(key)
+	if v == nil {
 		return false
 	}
-	v := ViperConfMap[keys[0]]
-	BoolConf := v.GetBool(strings.Join(keys[1:len(keys)], "."))
-	return BoolConf
+	return v.GetBool(subKey)
 }
 
 func GetFloat64Conf(key string) float64 {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	v, subKey := getConfViper(key)
+	if v == nil {
 		return 0
 	}
-	v := ViperConfMap[keys[0]]
-	Float64Conf := v.GetFloat64(strings.Join(keys[1:len(keys)], "."))
-	return Float64Conf
+	return v.GetFloat64(subKey)
 }
 
 func GetIntConf(key string) int {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	v, subKey := getConfViper(key)
+	if v == nil {
 		return 0
 	}
-	v := ViperConfMap[keys[0]]
-	IntConf := v.GetInt(strings.Join(keys[1:len(keys)], "."))
-	return IntConf
+	return v.GetInt(subKey)
 }
 
 func GetStringMapStringConf(key string) map[string]string {
-	keys := strings.Split(key, ".")
-	if len(key) < 2 {
+	v, subKey := getConfViper(key)
+	if v == nil {
 		return nil
 	}
-	v := ViperConfMap[keys[0]]
-	StringMapStringConf := v.GetStringMapString(strings.Join(keys[1:len(keys)], "."))
-	return StringMapStringConf
+	return v.GetStringMapString(subKey)
 }
 
 func GetStringSliceConf(key string) []string {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	v, subKey := getConfViper(key)
+	if v == nil {
 		return nil
 	}
-	v := ViperConfMap[keys[0]]
-	StringCliceConf := v.GetStringSlice(strings.Join(keys[1:len(keys)], "."))
-	return StringCliceConf
+	return v.GetStringSlice(subKey)
 }
 
 func GetTimeConf(key string) time.Time {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	v, subKey := getConfViper(key)
+	if v == nil {
 		return time.Now()
 	}
-	v := ViperConfMap[keys[0]]
-	TimeConf := v.GetTime(strings.Join(keys[1:len(keys)], "."))
-	return TimeConf
+	return v.GetTime(subKey)
 }
 
 func GetDurationConf(key string) time.Duration {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	v, subKey := getConfViper(key)
+	if v == nil {
 		return 0
 	}
-	v := ViperConfMap[keys[0]]
-	DurationConf := v.GetDuration(strings.Join(keys[1:len(keys)], "."))
-	return DurationConf
+	return v.GetDuration(subKey)
 }
 
 //是否设置了key
 func IsSetConf(key string) bool {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	v, subKey := getConfViper(key)
+	if v == nil {
 		return false
 	}
-	v := ViperConfMap[keys[0]]
-	IsSetConf := v.IsSet(strings.Join(keys[1:len(keys)], "."))
-	return IsSetConf
+	return v.IsSet(subKey)
 }
@@ -0,0 +1,270 @@
+package tool
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+//配置绑定或校验失败的错误汇总
+type ConfErrors []error
+
+func (e ConfErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+//将配置绑定到结构体，key为"文件名"或"文件名.key"，如 BindConf("base.log", &logConf)
+//字段通过mapstructure标签对应配置项，支持以下标签：
+//  default:"10"                   配置项未设置时使用的默认值，切片用逗号分隔，time.Duration使用"1s"格式
+//  validate:"required,min=1,max=100,oneof=a b"
+//min、max对数字比较数值，对字符串、切片、map比较长度
+func BindConf(key string, target interface{}) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("BindConf %s: target must be a non-nil pointer to struct, got %T", key, target)
+	}
+	keys := strings.SplitN(key, ".", 2)
+	file := keys[0]
+	v := getViperConf(file)
+	if v == nil {
+		return fmt.Errorf("BindConf %s: config file %s not found", key, GetConfPath(file))
+	}
+	subKey := ""
+	if len(keys) == 2 {
+		subKey = keys[1]
+	}
+	if subKey == "" || v.IsSet(subKey) {
+		if err := decodeConf(v, subKey, target, GetConfPath(file)); err != nil {
+			return fmt.Errorf("BindConf %s: %v", key, err)
+		}
+	}
+
+	b := &confBinder{v: v, file: GetConfPath(file)}
+	b.walk(rv.Elem(), subKey, key)
+	if len(b.errs) > 0 {
+		return b.errs
+	}
+	return nil
+}
+
+//设置默认值并校验，path为viper中的key，name为错误信息中的完整key
+type confBinder struct {
+	v    *viper.Viper
+	file string
+	errs ConfErrors
+}
+
+func (b *confBinder) errorf(name string, format string, args ...interface{}) {
+	b.errs = append(b.errs, fmt.Errorf("conf %s (%s): %s", name, b.file, fmt.Sprintf(format, args...)))
+}
+
+func (b *confBinder) walk(rv reflect.Value, path, name string) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("mapstructure"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag == "" {
+			tag = strings.ToLower(field.Name)
+		}
+		fieldPath, fieldName := confJoinKey(path, tag), confJoinKey(name, tag)
+		fv := rv.Field(i)
+
+		if def, ok := field.Tag.Lookup("default"); ok && !b.v.IsSet(fieldPath) && fv.IsZero() {
+			if err := confSetValue(fv, def); err != nil {
+				b.errorf(fieldName, "invalid default %q: %v", def, err)
+				continue
+			}
+		}
+		if rules := field.Tag.Get("validate"); rules != "" {
+			b.validate(fv, rules, fieldName)
+		}
+		b.walkValue(fv, fieldPath, fieldName)
+	}
+}
+
+//递归处理结构体、结构体指针以及map、切片中的结构体
+func (b *confBinder) walkValue(fv reflect.Value, path, name string) {
+	if fv.Type() == reflect.TypeOf(time.Time{}) {
+		return
+	}
+	switch fv.Kind() {
+	case reflect.Struct:
+		b.walk(fv, path, name)
+	case reflect.Ptr:
+		if !fv.IsNil() && fv.Elem().Kind() == reflect.Struct {
+			b.walk(fv.Elem(), path, name)
+		}
+	case reflect.Map:
+		if fv.Type().Key().Kind() != reflect.String {
+			return
+		}
+		for _, k := range fv.MapKeys() {
+			elem := fv.MapIndex(k)
+			if elem.Kind() == reflect.Ptr && !elem.IsNil() && elem.Elem().Kind() == reflect.Struct {
+				b.walk(elem.Elem(), confJoinKey(path, k.String()), confJoinKey(name, k.String()))
+			}
+		}
+	case reflect.Slice:
+		for j := 0; j < fv.Len(); j++ {
+			elem := fv.Index(j)
+			if elem.Kind() == reflect.Ptr && !elem.IsNil() {
+				elem = elem.Elem()
+			}
+			if elem.Kind() == reflect.Struct {
+				//切片中的元素无法通过viper判断是否设置，按字段是否为零值设置默认值
+				b.walk(elem, "\x00", fmt.Sprintf("%s[%d]", name, j))
+			}
+		}
+	}
+}
+
+func (b *confBinder) validate(fv reflect.Value, rules, name string) {
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		op, arg := rule, ""
+		if idx := strings.Index(rule, "="); idx >= 0 {
+			op, arg = rule[:idx], rule[idx+1:]
+		}
+		switch op {
+		case "required":
+			if confIsEmpty(fv) {
+				b.errorf(name, "is required")
+				return
+			}
+		case "min", "max":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				b.errorf(name, "invalid validate rule %q", rule)
+				continue
+			}
+			val, isLen, ok := confMeasure(fv)
+			if !ok {
+				b.errorf(name, "validate rule %q is not supported for %s", rule, fv.Type())
+				continue
+			}
+			what := "value"
+			if isLen {
+				what = "length"
+			}
+			if op == "min" && val < limit {
+				b.errorf(name, "%s %v is less than min %v", what, val, arg)
+			}
+			if op == "max" && val > limit {
+				b.errorf(name, "%s %v is greater than max %v", what, val, arg)
+			}
+		case "oneof":
+			options := strings.Fields(arg)
+			cur := fmt.Sprint(fv.Interface())
+			if !InArrayString(cur, options) {
+				b.errorf(name, "value %q is not one of [%s]", cur, strings.Join(options, " "))
+			}
+		default:
+			b.errorf(name, "unknown validate rule %q", rule)
+		}
+	}
+}
+
+func confJoinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+//零值、nil以及空的字符串、切片、map视为未设置
+func confIsEmpty(fv reflect.Value) bool {
+	switch fv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return fv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return fv.IsNil()
+	}
+	return fv.IsZero()
+}
+
+//数字返回数值，字符串、切片、map返回长度
+func confMeasure(fv reflect.Value) (float64, bool, bool) {
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(fv.Int()), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(fv.Uint()), false, true
+	case reflect.Float32, reflect.Float64:
+		return fv.Float(), false, true
+	case reflect.String, reflect.Slice, reflect.Map:
+		return float64(fv.Len()), true, true
+	}
+	return 0, false, false
+}
+
+//将字符串形式的值设置到字段
+func confSetValue(fv reflect.Value, s string) error {
+	if fv.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		val, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(val)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		val, err := strconv.ParseInt(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(val)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		val, err := strconv.ParseUint(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(val)
+	case reflect.Float32, reflect.Float64:
+		val, err := strconv.ParseFloat(s, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(val)
+	case reflect.Slice:
+		parts := []string{}
+		if s != "" {
+			parts = strings.Split(s, ",")
+		}
+		slice := reflect.MakeSlice(fv.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			if err := confSetValue(slice.Index(i), strings.TrimSpace(part)); err != nil {
+				return err
+			}
+		}
+		fv.Set(slice)
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+	return nil
+}
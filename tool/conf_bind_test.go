@@ -0,0 +1,69 @@
+package tool
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type confBindTestPool struct {
+	MaxOpenConn int           `mapstructure:"max_open_conn" default:"20" validate:"min=1"`
+	MaxIdleConn int           `mapstructure:"max_idle_conn" default:"10"`
+	Timeout     time.Duration `mapstructure:"timeout" default:"3s"`
+	Dsn         string        `mapstructure:"dsn" validate:"required"`
+	Mode        string        `mapstructure:"mode" default:"rw" validate:"oneof=rw ro"`
+}
+
+type confBindTestConf struct {
+	List map[string]*confBindTestPool `mapstructure:"list" validate:"min=1"`
+}
+
+func TestBindConf(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	v.ReadConfig(bytes.NewBufferString(`
+[list.default]
+    dsn="root@tcp(127.0.0.1:3306)/test"
+    max_idle_conn=0
+[list.bad]
+    max_open_conn=0
+    mode="wo"
+`))
+	ViperConfMap = map[string]*viper.Viper{"bind_test": v}
+	defer func() { ViperConfMap = nil }()
+
+	conf := &confBindTestConf{}
+	err := BindConf("bind_test", conf)
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, msg := range []string{
+		"conf bind_test.list.bad.max_open_conn",
+		"value 0 is less than min 1",
+		"conf bind_test.list.bad.dsn",
+		"is required",
+		`value "wo" is not one of [rw ro]`,
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("error %q should contain %q", err, msg)
+		}
+	}
+	def := conf.List["default"]
+	if def.MaxOpenConn != 20 || def.MaxIdleConn != 0 || def.Timeout != 3*time.Second || def.Mode != "rw" {
+		t.Fatalf("defaults not applied correctly: %+v", def)
+	}
+
+	pool := &confBindTestPool{}
+	if err := BindConf("bind_test.list.default", pool); err != nil || pool.MaxOpenConn != 20 {
+		t.Fatalf("unexpected result %+v %v", pool, err)
+	}
+	if err := BindConf("missing.list", pool); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expected missing file error, got %v", err)
+	}
+	if GetIntConf("missing.list.default") != 0 {
+		t.Fatal("getter on missing file should return zero value")
+	}
+}
@@ -0,0 +1,222 @@
+package tool
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+//公共配置目录：conf/common/下的文件作为各环境的基础配置，conf/<env>/下的同名文件深度合并覆盖
+const ConfCommonDir = "common"
+
+//支持的配置格式，按扩展名识别，同一目录下可以混用，但同一文件名只能有一种格式
+var confExts = []string{".toml", ".yaml", ".yml", ".json", ".hcl"}
+
+//配置文件中引用其他配置文件的key，被引用的文件先加载，当前文件覆盖其中的配置
+//  extends = "../common/mysql_map.toml"
+//  include = ["redis_base.toml", "redis_cache.toml"]
+//相对路径相对于当前文件所在目录
+const (
+	confExtendsKey = "extends"
+	confIncludeKey = "include"
+)
+
+//公共配置目录的路径，如 ./conf/dev -> ./conf/common
+func GetConfCommonPath() string {
+	if ConfEnvPath == "" || ConfEnv == ConfCommonDir {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(ConfEnvPath)), ConfCommonDir)
+}
+
+//按层级读取配置文件：公共配置 -> extends/include -> 当前文件 -> 环境变量和-set覆盖，并解析密钥引用
+//path位于环境目录时会合并公共目录下的同名文件，环境目录下不存在时只使用公共配置
+func readConfViper(path string) (*viper.Viper, error) {
+	layers := []string{}
+	commonPath, err := confCommonFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if commonPath != "" {
+		layers = append(layers, commonPath)
+	}
+	if _, err := os.Stat(path); err == nil || len(layers) == 0 {
+		layers = append(layers, path)
+	}
+
+	conf := map[string]interface{}{}
+	for _, layer := range layers {
+		m, err := readConfLayer(layer, nil)
+		if err != nil {
+			return nil, err
+		}
+		mergeConfMap(conf, m)
+	}
+	//解析${env:}、${file:}、enc:等密钥引用
+	if err := resolveConfSecrets(conf, path); err != nil {
+		return nil, err
+	}
+	v := viper.New()
+	if err := v.MergeConfigMap(conf); err != nil {
+		return nil, fmt.Errorf("Merge config %v failed,errMessage:%v", path, err)
+	}
+	if err := applyConfOverrides(confFileName(path), v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//环境目录下的配置文件对应的公共配置文件，格式可以不同，不在环境目录下或不存在时返回空
+func confCommonFile(path string) (string, error) {
+	commonPath := GetConfCommonPath()
+	if commonPath == "" || filepath.Clean(filepath.Dir(path)) != filepath.Clean(ConfEnvPath) {
+		return "", nil
+	}
+	return findConfFile(commonPath, confFileName(path))
+}
+
+//按扩展名识别配置格式
+func confType(path string) (string, bool) {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range confExts {
+		if e == ext {
+			if ext == ".yml" {
+				return "yaml", true
+			}
+			return strings.TrimPrefix(ext, "."), true
+		}
+	}
+	return "", false
+}
+
+//目录下的配置文件，文件名 -> 路径，同一文件名存在多种格式时返回错误
+func confDirFiles(dir string) (map[string]string, error) {
+	fileList, err := ioutil.ReadDir(dir + "/")
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, f := range fileList {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if _, ok := confType(f.Name()); !ok {
+			continue
+		}
+		name := confFileName(f.Name())
+		if exist, ok := files[name]; ok {
+			return nil, fmt.Errorf("Config conflict: %v and %v map to the same prefix %v", exist, filepath.Join(dir, f.Name()), name)
+		}
+		files[name] = filepath.Join(dir, f.Name())
+	}
+	return files, nil
+}
+
+//在目录下查找文件名对应的配置文件，不存在时返回空
+func findConfFile(dir, name string) (string, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return "", nil
+	}
+	files, err := confDirFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	return files[name], nil
+}
+
+//读取单个配置文件及其extends/include，visiting用于检测循环引用
+func readConfLayer(path string, visiting []string) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	if InArrayString(abs, visiting) {
+		return nil, fmt.Errorf("Config include cycle: %s -> %s", strings.Join(visiting, " -> "), abs)
+	}
+	visiting = append(visiting, abs)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Open config %v failed,errMessge:%v", path, err)
+	}
+	configType, ok := confType(path)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported config format %v, supported: %v", path, strings.Join(confExts, " "))
+	}
+	v := viper.New()
+	v.SetConfigType(configType)
+	if err := v.ReadConfig(bytes.NewBuffer(data)); err != nil {
+		return nil, fmt.Errorf("Parsing config %v failed,err:%v", path, err)
+	}
+	own := v.AllSettings()
+
+	refs := []string{}
+	if extends := v.GetString(confExtendsKey); extends != "" {
+		refs = append(refs, extends)
+	}
+	refs = append(refs, v.GetStringSlice(confIncludeKey)...)
+	delete(own, confExtendsKey)
+	delete(own, confIncludeKey)
+
+	conf := map[string]interface{}{}
+	for _, ref := range refs {
+		if !filepath.IsAbs(ref) {
+			ref = filepath.Join(filepath.Dir(path), ref)
+		}
+		m, err := readConfLayer(ref, visiting)
+		if err != nil {
+			return nil, err
+		}
+		mergeConfMap(conf, m)
+	}
+	mergeConfMap(conf, own)
+	return conf, nil
+}
+
+//将src深度合并到dst，同为map时递归合并，否则src覆盖dst
+func mergeConfMap(dst, src map[string]interface{}) {
+	for k, sv := range src {
+		if sm, ok := sv.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				mergeConfMap(dm, sm)
+				continue
+			}
+			//复制一份，避免后续合并修改src
+			cp := map[string]interface{}{}
+			mergeConfMap(cp, sm)
+			dst[k] = cp
+			continue
+		}
+		dst[k] = sv
+	}
+}
+
+//环境目录和公共目录下全部配置文件的路径，文件名 -> 路径
+//环境目录下的文件使用环境目录的路径，readConfViper会合并公共配置
+func confFileList() (map[string]string, error) {
+	files := map[string]string{}
+	if commonPath := GetConfCommonPath(); commonPath != "" {
+		if info, err := os.Stat(commonPath); err == nil && info.IsDir() {
+			commonFiles, err := confDirFiles(commonPath)
+			if err != nil {
+				return nil, err
+			}
+			for name, path := range commonFiles {
+				files[name] = path
+			}
+		}
+	}
+	envFiles, err := confDirFiles(ConfEnvPath)
+	if err != nil {
+		return nil, err
+	}
+	for name, path := range envFiles {
+		files[name] = path
+	}
+	return files, nil
+}
@@ -0,0 +1,118 @@
+package tool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadConfLayers(t *testing.T) {
+	root, err := ioutil.TempDir("", "conf_load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	write := func(name, content string) {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("common/mysql_map.toml", `
+[list.default]
+    driver_name="mysql"
+    data_source_name="root@tcp(127.0.0.1:3306)/test"
+    max_open_conn=20
+    max_idle_conn=10
+`)
+	write("prod/mysql_map.toml", `
+include=["pool.toml"]
+[list.default]
+    data_source_name="prod@tcp(10.0.0.1:3306)/prod"
+`)
+	write("prod/pool.toml", `
+[list.default]
+    max_open_conn=100
+`)
+	write("common/redis_map.toml", `
+[list.default]
+    proxy_list=["127.0.0.1:6379"]
+`)
+	write("prod/cycle_a.toml", `extends="cycle_b.toml"`)
+	write("prod/cycle_b.toml", `extends="cycle_a.toml"`)
+
+	oldPath, oldEnv := ConfEnvPath, ConfEnv
+	defer func() { ConfEnvPath, ConfEnv, ViperConfMap = oldPath, oldEnv, nil }()
+	if err := ParseConfPath(filepath.Join(root, "prod") + "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &MysqlMapConf{}
+	if err := ParseConfig(GetConfPath("mysql_map"), conf); err != nil {
+		t.Fatal(err)
+	}
+	def := conf.List["default"]
+	if def.DriverName != "mysql" || def.DataSourceName != "prod@tcp(10.0.0.1:3306)/prod" || def.MaxOpenConn != 100 || def.MaxIdleConn != 10 {
+		t.Fatalf("unexpected merged conf %+v", def)
+	}
+
+	//环境目录下不存在的文件使用公共配置
+	redisConf := &RedisMapConf{}
+	if err := ParseConfig(GetConfPath("redis_map"), redisConf); err != nil || len(redisConf.List["default"].ProxyList) != 1 {
+		t.Fatalf("unexpected redis conf %+v %v", redisConf, err)
+	}
+
+	if err := ParseConfig(GetConfPath("cycle_a"), &struct{}{}); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("expected include cycle error, got %v", err)
+	}
+
+	os.Remove(filepath.Join(root, "prod/cycle_a.toml"))
+	os.Remove(filepath.Join(root, "prod/cycle_b.toml"))
+	if err := InitViperConf(); err != nil {
+		t.Fatal(err)
+	}
+	if GetIntConf("mysql_map.list.default.max_open_conn") != 100 || IsSetConf("mysql_map.include") {
+		t.Fatal("ViperConfMap should contain merged config without include")
+	}
+	if len(GetStringSliceConf("redis_map.list.default.proxy_list")) != 1 {
+		t.Fatal("ViperConfMap should contain files only in common")
+	}
+}
+
+func TestReadConfFormats(t *testing.T) {
+	root, err := ioutil.TempDir("", "conf_format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "common"), 0755)
+	os.MkdirAll(filepath.Join(root, "dev"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "common", "base.yaml"), []byte("base:\n  debug_mode: release\n  time_location: UTC\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dev", "base.json"), []byte(`{"base": {"debug_mode": "debug"}}`), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dev", "app.hcl"), []byte(`name = "lib"`), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dev", "README.md"), []byte("ignored"), 0644)
+
+	oldPath, oldEnv := ConfEnvPath, ConfEnv
+	defer func() { ConfEnvPath, ConfEnv, ViperConfMap = oldPath, oldEnv, nil }()
+	ParseConfPath(filepath.Join(root, "dev") + "/")
+	if err := InitViperConf(); err != nil {
+		t.Fatal(err)
+	}
+	if GetStringConf("base.base.debug_mode") != "debug" || GetStringConf("base.base.time_location") != "UTC" {
+		t.Fatal("json config should be merged over yaml common config")
+	}
+	if GetStringConf("app.name") != "lib" {
+		t.Fatal("hcl config should be loaded")
+	}
+	if IsSetConf("README.md") || GetConf("README.ignored") != nil {
+		t.Fatal("unsupported files should be ignored")
+	}
+
+	ioutil.WriteFile(filepath.Join(root, "dev", "base.toml"), []byte("[base]\ndebug_mode=\"test\"\n"), 0644)
+	if err := InitViperConf(); err == nil || !strings.Contains(err.Error(), "same prefix base") {
+		t.Fatalf("expected conflict error, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package tool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+//环境变量覆盖配置的前缀，如 LIB_MYSQL_MAP__LIST__DEFAULT__MAX_OPEN_CONN=50
+//覆盖 mysql_map.toml 中的 list.default.max_open_conn，"__"对应配置key中的"."
+const ConfEnvPrefix = "LIB_"
+
+//配置覆盖的优先级：-set key=value > 环境变量 > 配置文件
+var (
+	confOverrideMu sync.RWMutex
+	confOverrides  = map[string]map[string]string{} //文件名 -> key -> value
+)
+
+//设置配置覆盖，key为"文件名.key"，如 SetConfOverride("mysql_map.list.default.max_open_conn", "50")
+//在InitModule之前调用，之后加载的配置生效
+func SetConfOverride(key, value string) error {
+	keys := strings.SplitN(key, ".", 2)
+	if len(keys) < 2 || keys[0] == "" || keys[1] == "" {
+		return fmt.Errorf("invalid conf override key %q, such as : mysql_map.list.default.max_open_conn", key)
+	}
+	confOverrideMu.Lock()
+	defer confOverrideMu.Unlock()
+	file := strings.ToLower(keys[0])
+	if confOverrides[file] == nil {
+		confOverrides[file] = map[string]string{}
+	}
+	confOverrides[file][strings.ToLower(keys[1])] = value
+	return nil
+}
+
+//清除全部SetConfOverride设置的覆盖，环境变量覆盖不受影响
+func ClearConfOverrides() {
+	confOverrideMu.Lock()
+	defer confOverrideMu.Unlock()
+	confOverrides = map[string]map[string]string{}
+}
+
+//从命令行参数中读取全部 -set key=value
+func initConfOverrides(args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		kv := ""
+		switch {
+		case arg == "-set" || arg == "--set":
+			if i+1 >= len(args) {
+				return fmt.Errorf("flag %s needs an argument: key=value", arg)
+			}
+			i++
+			kv = args[i]
+		case strings.HasPrefix(arg, "-set="):
+			kv = strings.TrimPrefix(arg, "-set=")
+		case strings.HasPrefix(arg, "--set="):
+			kv = strings.TrimPrefix(arg, "--set=")
+		default:
+			continue
+		}
+		idx := strings.Index(kv, "=")
+		if idx <= 0 {
+			return fmt.Errorf("invalid -set %q, such as : -set mysql_map.list.default.max_open_conn=50", kv)
+		}
+		if err := SetConfOverride(kv[:idx], kv[idx+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//环境变量中属于该配置文件的覆盖
+func confEnvOverrides(file string) map[string]string {
+	res := map[string]string{}
+	prefix := ConfEnvPrefix + strings.ToUpper(file) + "__"
+	for _, env := range os.Environ() {
+		idx := strings.Index(env, "=")
+		if idx < 0 || !strings.HasPrefix(env[:idx], prefix) {
+			continue
+		}
+		key := strings.TrimPrefix(env[:idx], prefix)
+		if key == "" {
+			continue
+		}
+		res[strings.ToLower(strings.Replace(key, "__", ".", -1))] = env[idx+1:]
+	}
+	return res
+}
+
+//将环境变量和-set的覆盖设置到该配置文件的viper，覆盖的值同样支持密钥引用
+func applyConfOverrides(file string, v *viper.Viper) error {
+	overrides := confEnvOverrides(file)
+	confOverrideMu.RLock()
+	for key, value := range confOverrides[strings.ToLower(file)] {
+		overrides[key] = value
+	}
+	confOverrideMu.RUnlock()
+	for key, value := range overrides {
+		resolved, err := resolveConfString(value)
+		if err != nil {
+			return fmt.Errorf("Resolve config override %v.%v failed,err:%v", file, key, err)
+		}
+		v.Set(key, resolved)
+	}
+	return nil
+}
+
+//配置文件路径对应的文件名，即配置key的前缀，如 ./conf/dev/mysql_map.toml -> mysql_map
+func confFileName(path string) string {
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
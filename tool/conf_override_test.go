@@ -0,0 +1,46 @@
+package tool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf_override")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mysql_map.toml")
+	ioutil.WriteFile(path, []byte(`
+[list.default]
+    driver_name="mysql"
+    data_source_name="root@tcp(127.0.0.1:3306)/test"
+    max_open_conn=20
+    max_idle_conn=10
+`), 0644)
+
+	os.Setenv("LIB_MYSQL_MAP__LIST__DEFAULT__MAX_OPEN_CONN", "50")
+	os.Setenv("LIB_MYSQL_MAP__LIST__DEFAULT__MAX_IDLE_CONN", "30")
+	defer os.Unsetenv("LIB_MYSQL_MAP__LIST__DEFAULT__MAX_OPEN_CONN")
+	defer os.Unsetenv("LIB_MYSQL_MAP__LIST__DEFAULT__MAX_IDLE_CONN")
+	defer func() { confOverrides = map[string]map[string]string{} }()
+	if err := initConfOverrides([]string{"-config", "./conf/dev/", "-set", "mysql_map.list.default.max_idle_conn=5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &MysqlMapConf{}
+	if err := ParseConfig(path, conf); err != nil {
+		t.Fatal(err)
+	}
+	def := conf.List["default"]
+	if def.MaxOpenConn != 50 || def.MaxIdleConn != 5 || def.DriverName != "mysql" {
+		t.Fatalf("overrides not applied: %+v", def)
+	}
+
+	if err := initConfOverrides([]string{"-set", "novalue"}); err == nil {
+		t.Fatal("expected invalid -set error")
+	}
+}
@@ -0,0 +1,120 @@
+package tool
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+//解析配置到结构体时对未使用的key的处理方式
+const (
+	ConfStrictOff   = iota //忽略
+	ConfStrictWarn         //打印警告
+	ConfStrictError        //返回错误
+)
+
+//ParseConfig、BindConf的严格模式，默认打印警告
+//结构体标签错误（如mapstructure拼写错误、多个字段对应同一个key）在ConfStrictWarn、ConfStrictError下均返回错误
+var ConfStrictMode = ConfStrictWarn
+
+//按严格模式将配置解析到结构体，subKey为空时解析整个文件
+func decodeConf(v *viper.Viper, subKey string, conf interface{}, path string) error {
+	md := &mapstructure.Metadata{}
+	withMetadata := func(c *mapstructure.DecoderConfig) {
+		c.Metadata = md
+	}
+	var err error
+	if subKey == "" {
+		err = v.Unmarshal(conf, withMetadata)
+	} else {
+		err = v.UnmarshalKey(subKey, conf, withMetadata)
+	}
+	if err != nil {
+		return fmt.Errorf("Parsing config failed ,config:%v,err:%v", path, err)
+	}
+	if ConfStrictMode == ConfStrictOff {
+		return nil
+	}
+
+	errs := ConfErrors{}
+	for _, e := range checkConfTags(reflect.TypeOf(conf), "", map[reflect.Type]bool{}) {
+		errs = append(errs, fmt.Errorf("config %v: %s", path, e))
+	}
+	unused := ConfErrors{}
+	for _, key := range md.Unused {
+		unused = append(unused, fmt.Errorf("config %v: key %s is not used by %T", path, confJoinKey(subKey, key), conf))
+	}
+	if ConfStrictMode == ConfStrictError {
+		errs = append(errs, unused...)
+	} else {
+		for _, e := range unused {
+			log.Printf("[WARN] %s\n", e)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//检查结构体的mapstructure标签：拼写错误、多个字段对应同一个key
+func checkConfTags(t reflect.Type, name string, visited map[reflect.Type]bool) []string {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Map || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || visited[t] {
+		return nil
+	}
+	visited[t] = true
+	res := []string{}
+	keys := map[string]string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fieldName := t.Name() + "." + field.Name
+		if name != "" {
+			fieldName = name + "." + field.Name
+		}
+		tag, ok := field.Tag.Lookup("mapstructure")
+		if !ok {
+			if typo := confTagTypo(field.Tag); typo != "" {
+				res = append(res, fmt.Sprintf("field %s has tag %q, should be \"mapstructure\"", fieldName, typo))
+			}
+			tag = strings.ToLower(field.Name)
+		}
+		key := strings.Split(tag, ",")[0]
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+		if exist, ok := keys[key]; ok {
+			res = append(res, fmt.Sprintf("fields %s and %s both map to key %s", exist, fieldName, key))
+		}
+		keys[key] = fieldName
+		res = append(res, checkConfTags(field.Type, fieldName, visited)...)
+	}
+	return res
+}
+
+//形如mapstructure的错误标签名
+func confTagTypo(tag reflect.StructTag) string {
+	for _, part := range strings.Fields(string(tag)) {
+		idx := strings.Index(part, ":")
+		if idx <= 0 {
+			continue
+		}
+		key := part[:idx]
+		if key != "mapstructure" && strings.HasPrefix(key, "map") && strings.Contains(key, "str") {
+			return key
+		}
+	}
+	return ""
+}
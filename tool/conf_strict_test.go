@@ -0,0 +1,53 @@
+package tool
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+type confStrictTestConf struct {
+	Name    string `mapstructure:"name"`
+	Path    string `mapstructure:"path"`
+	Typo    string `mapstructrue:"typo"`
+	DupPath string `mapstructure:"path"`
+}
+
+func TestDecodeConfStrict(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	v.ReadConfig(bytes.NewBufferString("name=\"lib\"\n[log.file.writer]\non=true\n"))
+
+	defer func(mode int) { ConfStrictMode = mode }(ConfStrictMode)
+	ConfStrictMode = ConfStrictError
+	conf := &LogConfig{}
+	err := decodeConf(v, "log", conf, "base.toml")
+	if err == nil || !strings.Contains(err.Error(), "config base.toml: key log.file is not used") {
+		t.Fatalf("expected unused key error, got %v", err)
+	}
+
+	ConfStrictMode = ConfStrictWarn
+	if err := decodeConf(v, "log", conf, "base.toml"); err != nil {
+		t.Fatalf("unused key should only warn, got %v", err)
+	}
+	err = decodeConf(v, "", &confStrictTestConf{}, "test.toml")
+	if err == nil || !strings.Contains(err.Error(), `has tag "mapstructrue"`) || !strings.Contains(err.Error(), "both map to key path") {
+		t.Fatalf("expected tag errors, got %v", err)
+	}
+
+	ConfStrictMode = ConfStrictOff
+	if err := decodeConf(v, "", &confStrictTestConf{}, "test.toml"); err != nil {
+		t.Fatal(err)
+	}
+
+	//内置的配置结构体标签正确
+	ConfStrictMode = ConfStrictError
+	for _, c := range []interface{}{&BaseConf{}, &MysqlMapConf{}, &RedisMapConf{}} {
+		if errs := checkConfTags(reflect.TypeOf(c), "", map[reflect.Type]bool{}); len(errs) > 0 {
+			t.Errorf("%T: %v", c, errs)
+		}
+	}
+}
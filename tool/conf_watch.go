@@ -0,0 +1,268 @@
+package tool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+const (
+	DLTagConfReloadSuccess = "_com_conf_reload_success" //配置热更新成功
+	DLTagConfReloadFailed  = "_com_conf_reload_failure" //配置热更新失败
+)
+
+const (
+	confWatchDebounce     = 100 * time.Millisecond //合并短时间内的多次文件变更
+	confWatchPollInterval = 2 * time.Second        //fsnotify不可用时的轮询间隔
+)
+
+type confChangeHandler struct {
+	key string
+	fn  func(key string, value interface{})
+}
+
+var (
+	confHandlerMu sync.RWMutex
+	confHandlers  []confChangeHandler
+
+	confWatchMu   sync.Mutex
+	confWatchStop chan struct{}
+	confWatchDone chan struct{}
+	confReloadMu  sync.Mutex
+)
+
+//订阅配置变更，key为"文件名"或"文件名.key"，如 OnConfChange("mysql_map.list.default", fn)
+//配置热更新后key对应的值发生变化时调用fn，value为新的值，配置被删除时为nil
+func OnConfChange(key string, fn func(key string, value interface{})) {
+	confHandlerMu.Lock()
+	defer confHandlerMu.Unlock()
+	confHandlers = append(confHandlers, confChangeHandler{key: key, fn: fn})
+}
+
+//监听环境目录和公共目录下的配置文件，变更后重新加载ViperConfMap
+//优先使用fsnotify，不可用时降级为轮询
+func WatchConf() error {
+	confWatchMu.Lock()
+	defer confWatchMu.Unlock()
+	if confWatchStop != nil {
+		return nil
+	}
+	dirs := confWatchDirs()
+	if len(dirs) == 0 {
+		return fmt.Errorf("conf path is not set")
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		for _, dir := range dirs {
+			if err = watcher.Add(dir); err != nil {
+				watcher.Close()
+				break
+			}
+		}
+	}
+	if err != nil {
+		Log.TagWarn(NewTrace(), DLTagConfReloadFailed, map[string]interface{}{
+			"msg": "fsnotify unavailable, fallback to polling",
+			"err": err,
+		})
+		go confPollLoop(dirs, stop, done)
+	} else {
+		go confNotifyLoop(watcher, stop, done)
+	}
+	confWatchStop, confWatchDone = stop, done
+	return nil
+}
+
+//停止监听配置文件
+func StopWatchConf() error {
+	confWatchMu.Lock()
+	defer confWatchMu.Unlock()
+	if confWatchStop == nil {
+		return nil
+	}
+	close(confWatchStop)
+	<-confWatchDone
+	confWatchStop, confWatchDone = nil, nil
+	return nil
+}
+
+//需要监听的目录
+func confWatchDirs() []string {
+	if ConfEnvPath == "" {
+		return nil
+	}
+	dirs := []string{ConfEnvPath}
+	if commonPath := GetConfCommonPath(); commonPath != "" {
+		if _, err := ioutil.ReadDir(commonPath); err == nil {
+			dirs = append(dirs, commonPath)
+		}
+	}
+	return dirs
+}
+
+func confNotifyLoop(watcher *fsnotify.Watcher, stop, done chan struct{}) {
+	defer close(done)
+	defer watcher.Close()
+	timer := time.NewTimer(confWatchDebounce)
+	timer.Stop()
+	for {
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Chmod == event.Op {
+				continue
+			}
+			timer.Reset(confWatchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			Log.TagWarn(NewTrace(), DLTagConfReloadFailed, map[string]interface{}{
+				"msg": "fsnotify error",
+				"err": err,
+			})
+		case <-timer.C:
+			ReloadConf()
+		}
+	}
+}
+
+func confPollLoop(dirs []string, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(confWatchPollInterval)
+	defer ticker.Stop()
+	last := confDirSnapshot(dirs)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			cur := confDirSnapshot(dirs)
+			if cur != last {
+				last = cur
+				ReloadConf()
+			}
+		}
+	}
+}
+
+//目录下文件的名称、大小和修改时间
+func confDirSnapshot(dirs []string) string {
+	items := []string{}
+	for _, dir := range dirs {
+		fileList, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range fileList {
+			items = append(items, fmt.Sprintf("%s/%s:%d:%d", dir, f.Name(), f.Size(), f.ModTime().UnixNano()))
+		}
+	}
+	sort.Strings(items)
+	return strings.Join(items, "\n")
+}
+
+//重新加载全部配置文件并整体替换ViperConfMap，解析失败的文件保留原来的配置，已删除的文件被移除
+//返回解析失败的文件的错误
+func ReloadConf() error {
+	confReloadMu.Lock()
+	defer confReloadMu.Unlock()
+	startExecTime := time.Now()
+	trace := NewTrace()
+
+	files, err := confFileList()
+	if err != nil {
+		Log.TagError(trace, DLTagConfReloadFailed, map[string]interface{}{
+			"err": err,
+		})
+		return err
+	}
+	viperConfMu.RLock()
+	oldMap := ViperConfMap
+	viperConfMu.RUnlock()
+	//只包含仍然存在的文件，已删除的文件从ViperConfMap中移除
+	newMap := make(map[string]*viper.Viper, len(files))
+	errs := ConfErrors{}
+	for name, path := range files {
+		v, err := readConfViper(path)
+		if err != nil {
+			errs = append(errs, err)
+			if old, ok := oldMap[name]; ok {
+				newMap[name] = old
+			}
+			continue
+		}
+		newMap[name] = v
+	}
+	viperConfMu.Lock()
+	ViperConfMap = newMap
+	viperConfMu.Unlock()
+
+	changed := notifyConfChange(oldMap, newMap)
+	endExecTime := time.Now()
+	if len(errs) > 0 {
+		Log.TagError(trace, DLTagConfReloadFailed, map[string]interface{}{
+			"err":       errs,
+			"changed":   changed,
+			"proc_time": fmt.Sprintf("%fs", endExecTime.Sub(startExecTime).Seconds()),
+		})
+		return errs
+	}
+	Log.TagInfo(trace, DLTagConfReloadSuccess, map[string]interface{}{
+		"changed":   changed,
+		"proc_time": fmt.Sprintf("%fs", endExecTime.Sub(startExecTime).Seconds()),
+	})
+	return nil
+}
+
+//对比新旧配置，调用值发生变化的订阅，返回发生变化的key
+func notifyConfChange(oldMap, newMap map[string]*viper.Viper) []string {
+	confHandlerMu.RLock()
+	handlers := append([]confChangeHandler{}, confHandlers...)
+	confHandlerMu.RUnlock()
+	changed := []string{}
+	for _, h := range handlers {
+		newVal := confMapValue(newMap, h.key)
+		if reflect.DeepEqual(confMapValue(oldMap, h.key), newVal) {
+			continue
+		}
+		changed = append(changed, h.key)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					Log.TagError(NewTrace(), DLTagConfReloadFailed, map[string]interface{}{
+						"key": h.key,
+						"err": fmt.Sprintf("conf change handler panic: %v", r),
+					})
+				}
+			}()
+			h.fn(h.key, newVal)
+		}()
+	}
+	return changed
+}
+
+func confMapValue(m map[string]*viper.Viper, key string) interface{} {
+	keys := strings.SplitN(key, ".", 2)
+	v := m[keys[0]]
+	if v == nil {
+		return nil
+	}
+	if len(keys) == 1 {
+		return v.AllSettings()
+	}
+	return v.Get(keys[1])
+}
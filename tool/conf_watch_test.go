@@ -0,0 +1,76 @@
+package tool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConf(t *testing.T) {
+	root, err := ioutil.TempDir("", "conf_watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "dev", "mysql_map.toml")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	ioutil.WriteFile(path, []byte("[list.default]\nmax_open_conn=20\n"), 0644)
+
+	oldPath, oldEnv := ConfEnvPath, ConfEnv
+	defer func() {
+		ConfEnvPath, ConfEnv, ViperConfMap = oldPath, oldEnv, nil
+		confHandlers = nil
+	}()
+	ParseConfPath(filepath.Join(root, "dev") + "/")
+	if err := InitViperConf(); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan interface{}, 10)
+	OnConfChange("mysql_map.list.default.max_open_conn", func(key string, value interface{}) {
+		changes <- value
+	})
+	if err := WatchConf(); err != nil {
+		t.Fatal(err)
+	}
+	defer StopWatchConf()
+
+	ioutil.WriteFile(path, []byte("[list.default]\nmax_open_conn=50\n"), 0644)
+	select {
+	case v := <-changes:
+		if GetIntConf("mysql_map.list.default.max_open_conn") != 50 {
+			t.Fatalf("config not reloaded, callback value %v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change callback not called")
+	}
+
+	//解析失败时保留原来的配置
+	ioutil.WriteFile(path, []byte("[list.default\nmax_open_conn=\n"), 0644)
+	if err := ReloadConf(); err == nil {
+		t.Fatal("expected parse error")
+	}
+	if GetIntConf("mysql_map.list.default.max_open_conn") != 50 {
+		t.Fatal("previous config should be kept on parse error")
+	}
+
+	//文件删除后移除配置，订阅收到nil
+	os.Remove(path)
+	ReloadConf()
+	select {
+	case v := <-changes:
+		if v != nil {
+			t.Fatalf("expected nil after file removed, got %v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change callback not called after file removed")
+	}
+	viperConfMu.RLock()
+	_, ok := ViperConfMap["mysql_map"]
+	viperConfMu.RUnlock()
+	if ok {
+		t.Fatal("removed config file should be dropped")
+	}
+}
@@ -1,10 +1,6 @@
 package tool
 
 import (
-	"bytes"
-	"fmt"
-	"github.com/spf13/viper"
-	"io/ioutil"
 	"os"
 	"strings"
 )
@@ -33,8 +29,14 @@ func GetConfEnv() string {
 	return ConfEnv
 }
 
-//获取配置文件完整路径
+//获取配置文件完整路径，按扩展名查找环境目录下的toml、yaml、json、hcl文件，都不存在时为toml
 func GetConfPath(fileName string) string {
+	for _, ext := range confExts {
+		path := ConfEnvPath + "/" + fileName + ext
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
 	return ConfEnvPath + "/" + fileName + ".toml"
 }
 
@@ -52,24 +54,12 @@ func ParseLocalConfig(fileName string, conf interface{}) error {
 	return nil
 }
 
-//解析配置
+//解析配置：合并公共配置、extends/include，并应用环境变量和-set覆盖
 func ParseConfig(path string, conf interface{}) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("Open config %v failed,errMessge:%v", path, err)
-	}
-	//读取文件
-	data, err := ioutil.ReadAll(file)
+	v, err := readConfViper(path)
 	if err != nil {
-		return fmt.Errorf("Read config failed,errMessage:%v", err)
-	}
-	v := viper.New()
-	//设置配置类型
-	v.SetConfigType("toml")
-	v.ReadConfig(bytes.NewBuffer(data))
-	if err := v.Unmarshal(conf); err != nil {
-		return fmt.Errorf("Parsing config failed ,config:%v,err:%v", string(data), err)
+		return err
 	}
-	return nil
-
+	//严格模式检查未使用的key和结构体标签，见ConfStrictMode
+	return decodeConf(v, "", conf, path)
 }
@@ -5,15 +5,11 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
-	"flag"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	dlog "lib/log"
 	"log"
 	"math/rand"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -33,17 +29,17 @@ func Init(configPath string) error {
 	return InitModule(configPath, []string{"base", "mysql", "redis"})
 }
 
-//模块初始化
+//模块初始化：按依赖顺序初始化modules中的模块及其依赖，返回全部模块的错误
+//configPath为空时从命令行参数 -config 读取，配置项可通过 -set key=value 或环境变量覆盖，见ConfEnvPrefix
+//重复调用时已初始化的模块不会再次初始化
 func InitModule(configPath string, modules []string) error {
-	conf := flag.String("config", configPath, "input config file ,such as : ./conf/dev/")
-	flag.Parse()
-	if *conf == "" {
-		flag.Usage()
-		os.Exit(1)
+	conf := configArg(os.Args[1:], configPath)
+	if conf == "" {
+		return errors.New("config path is empty, such as : -config ./conf/dev/")
 	}
 
 	log.Println("------------------------------------------------------------------------")
-	log.Printf("[INFO] config=%s\n", *conf)
+	log.Printf("[INFO] config=%s\n", conf)
 	log.Printf("[INFO] %s\n", " start loading resouces.")
 
 	//设置ip信息，优先设置便于日志打印
@@ -53,52 +49,59 @@ func InitModule(configPath string, modules []string) error {
 	}
 
 	//解析配置文件目录
-	if err := ParseConfPath(*conf); err != nil {
+	if err := ParseConfPath(conf); err != nil {
 		return err
 	}
 
-	//初始化配置文件
-	if err := InitViperConf(); err != nil {
+	//读取命令行中的 -set key=value 配置覆盖
+	if err := initConfOverrides(os.Args[1:]); err != nil {
 		return err
 	}
 
-	//加载base配置
-	if InArrayString("base", modules) {
-		if err := InitBaseConf(GetConfPath("base")); err != nil {
-			fmt.Printf("[ERROR] %s%s\n", time.Now().Format(TimeFormat), " InitBaseConf:"+err.Error())
-		}
-	}
-
-	//加载redis配置
-	if InArrayString("redis", modules) {
-		if err := InitBaseConf(GetConfPath("redis_map")); err != nil {
-			fmt.Printf("[ERROR] %s%s\n", time.Now().Format(TimeFormat), " InitRedisConf:"+err.Error())
-		}
+	//初始化配置文件
+	if err := InitViperConf(); err != nil {
+		return err
 	}
 
-	//加载mysql配置并初始化实例
-	if InArrayString("mysql", modules) {
-		if err := InitBaseConf(GetConfPath("mysql_map")); err != nil {
-			fmt.Printf("[ERROR] %s%s\n", time.Now().Format(TimeFormat), " InitDBPool:"+err.Error())
-		}
+	//兼容：base模块原来同时初始化日志
+	if InArrayString("base", modules) && !InArrayString("log", modules) {
+		modules = append(append([]string{}, modules...), "log")
 	}
-	//设置时区
-	if location, err := time.LoadLocation(ConfBase.TimeLocation); err != nil {
+	if err := initModules(modules); err != nil {
+		log.Printf("[ERROR] %s\n", " loading resources failed: "+err.Error())
 		return err
-	} else {
-		TimeLocation = location
 	}
 	log.Printf("[INFO] %s\n", " success loading resources.")
 	log.Println("------------------------------------------------------------------------")
 	return nil
 }
 
-//公共销毁函数
+//从命令行参数中读取 -config，不使用全局的flag，避免与业务的命令行参数冲突
+func configArg(args []string, def string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		for _, name := range []string{"-config", "--config"} {
+			if arg == name && i+1 < len(args) {
+				return args[i+1]
+			}
+			if strings.HasPrefix(arg, name+"=") {
+				return strings.TrimPrefix(arg, name+"=")
+			}
+		}
+	}
+	return def
+}
+
+//公共销毁函数：按初始化的相反顺序销毁模块
 func Destroy() {
 	log.Println("------------------------------------------------------------------------")
 	log.Printf("[INFO] %s\n", " starting destory resources.")
-	CloseDB()
-	dlog.Close()
+	if err := destroyResources(); err != nil {
+		log.Printf("[ERROR] %s\n", " destory resources: "+err.Error())
+	}
 	log.Printf("[INFO] %s\n", "destory resources successfully.")
 }
 func InArrayString(base string, modules []string) bool {
@@ -125,188 +128,6 @@ func GetLocalIPs() (ips []net.IP) {
 	return ips
 }
 
-//GET请求
-func HttpGET(trace *TraceContext, urlString string, urlParams url.Values, msTimeout int, header http.Header) (*http.Response, []byte, error) {
-	startTime := time.Now().UnixNano()
-	client := http.Client{
-		Timeout: time.Duration(msTimeout) * time.Millisecond,
-	}
-	urlString = AddGetDataToUrl(urlString, urlParams)
-	//get请求
-	req, err := http.NewRequest("GET", urlString, nil)
-	if err != nil {
-		Log.TagWarn(trace, DLTagHTTPFailed, map[string]interface{}{
-			"url":       urlString,
-			"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9, //1.0e9 10^9
-			"method":    "GET",
-			"args":      urlParams,
-			"err":       err.Error(),
-		})
-		return nil, nil, err
-	}
-	if len(header) > 0 {
-		req.Header = header
-	}
-
-	req = addTrace2Header(req, trace)
-	//执行get请求
-	resp, err := client.Do(req)
-	if err != nil {
-		Log.TagWarn(trace, DLTagHTTPFailed, map[string]interface{}{
-			"url":       urlString,
-			"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
-			"method":    "GET",
-			"args":      urlParams,
-			"err":       err.Error(),
-		})
-	}
-	//执行成功
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		Log.TagWarn(trace, DLTagHTTPFailed, map[string]interface{}{
-			"url":       urlString,
-			"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
-			"method":    "GET",
-			"args":      urlParams,
-			"result":    Substr(string(body), 0, 1024),
-		})
-	}
-
-	//读取成功
-	Log.TagInfo(trace, DLTagHTTPSuccess, map[string]interface{}{
-		"url":       urlString,
-		"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
-		"method":    "GET",
-		"args":      urlParams,
-		"result":    Substr(string(body), 0, 1024),
-	})
-	return resp, body, nil
-}
-
-//POST请求
-func HttpPOST(trace *TraceContext, urlString string, urlParams url.Values, msTimeout int, header http.Header, contextType string) (*http.Response, []byte, error) {
-	startTime := time.Now().UnixNano()
-	client := http.Client{
-		Timeout: time.Duration(msTimeout) * time.Millisecond,
-	}
-	if contextType == "" {
-		contextType = "application/x-www-form-urlencoded"
-	}
-	urlParamEncode := urlParams.Encode()
-	req, err := http.NewRequest("POST", urlString, strings.NewReader(urlParamEncode))
-	if len(header) > 0 {
-		req.Header = header
-	}
-	//添加trace
-	req = addTrace2Header(req, trace)
-	req.Header.Set("Content-Type", contextType)
-	//执行post请求
-	resp, err := client.Do(req)
-	if err != nil {
-		Log.TagWarn(trace, DLTagHTTPFailed, map[string]interface{}{
-			"url":       urlString,
-			"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
-			"method":    "POST",
-			"args":      Substr(urlParamEncode, 0, 1024),
-			"err":       err.Error(),
-		})
-		return nil, nil, err
-	}
-	//执行成功
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		Log.TagWarn(trace, DLTagHTTPFailed, map[string]interface{}{
-			"url":       urlString,
-			"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
-			"method":    "POST",
-			"args":      Substr(urlParamEncode, 0, 1024),
-			"err":       err.Error(),
-			"result":    Substr(string(body), 0, 1024),
-		})
-	}
-	//读取成功
-	Log.TagInfo(trace, DLTagHTTPSuccess, map[string]interface{}{
-		"url":       urlString,
-		"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
-		"method":    "POST",
-		"args":      Substr(urlParamEncode, 0, 1024),
-		"result":    Substr(string(body), 0, 1024),
-	})
-	return resp, body, nil
-}
-
-func HttpJSON(trace *TraceContext, urlString string, jsonContent string, msTimeout int, header http.Header) (*http.Response, []byte, error) {
-	startTime := time.Now().UnixNano()
-	client := http.Client{
-		Timeout: time.Duration(msTimeout) * time.Millisecond,
-	}
-	req, err := http.NewRequest("POST", urlString, strings.NewReader(jsonContent))
-	if len(header) > 0 {
-		req.Header = header
-	}
-	req = addTrace2Header(req, trace)
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		Log.TagWarn(trace, DLTagHTTPFailed, map[string]interface{}{
-			"url":       urlString,
-			"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
-			"method":    "POST",
-			"args":      Substr(jsonContent, 0, 1024),
-			"err":       err.Error(),
-		})
-		return nil, nil, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		Log.TagWarn(trace, DLTagHTTPFailed, map[string]interface{}{
-			"url":       urlString,
-			"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
-			"method":    "POST",
-			"args":      Substr(jsonContent, 0, 1024),
-			"err":       err.Error(),
-			"result":    Substr(string(body), 0, 1024),
-		})
-	}
-	//读取成功
-	Log.TagInfo(trace, DLTagHTTPSuccess, map[string]interface{}{
-		"url":       urlString,
-		"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
-		"method":    "POST",
-		"args":      Substr(jsonContent, 0, 1024),
-		"result":    Substr(string(body), 0, 1024),
-	})
-	return resp, body, nil
-
-}
-
-//将受到的数据组成链接：a=%2A&b=%2A
-func AddGetDataToUrl(urlString string, data url.Values) string {
-	if strings.Contains(urlString, "?") {
-		urlString = urlString + "&"
-	} else {
-		urlString = urlString + "?"
-	}
-	return fmt.Sprintf("%s%s", urlString, data.Encode())
-}
-
-//将traceId和cSpanId添加到header中
-func addTrace2Header(request *http.Request, trace *TraceContext) *http.Request {
-	traceId := trace.TraceId
-	cSpanId := NewSpanId()
-	if traceId != "" {
-		request.Header.Set("didi-header-rid", traceId)
-	}
-	if cSpanId != "" {
-		request.Header.Set("didi-header-spanid", cSpanId)
-	}
-	trace.CSpanId = cSpanId
-	return request
-}
-
 func NewSpanId() string {
 	timestamp := uint32(time.Now().Unix())
 	ipToLong := binary.BigEndian.Uint32(LocalIP.To4())
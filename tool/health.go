@@ -0,0 +1,354 @@
+package tool
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+//健康检查的间隔和单次检查的超时时间，需要在StartHealthCheck之前设置
+//InitModule初始化mysql或redis模块后会自动开始定期检查
+var (
+	HealthCheckInterval = 10 * time.Second
+	HealthCheckTimeout  = 2 * time.Second
+)
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+)
+
+//单个连接池的检查结果
+type HealthCheck struct {
+	Name      string      `json:"name"` //mysql.<配置名>、gorm.<配置名>、mysql.<配置名>#<从库序号>、redis.<配置名>
+	Healthy   bool        `json:"healthy"`
+	Optional  bool        `json:"optional,omitempty"` //从库不可用时读主库，不影响就绪状态
+	Error     string      `json:"error,omitempty"`
+	ProcTime  string      `json:"proc_time,omitempty"`
+	CheckedAt time.Time   `json:"checked_at"`
+	Stats     interface{} `json:"stats,omitempty"` //sql.DBStats或redis.PoolStats
+}
+
+//汇总的健康状态，Live为进程存活（检查循环仍在运行），Ready为全部必需的连接池可用且未在关闭中
+type HealthReport struct {
+	Status    string        `json:"status"`
+	Live      bool          `json:"live"`
+	Ready     bool          `json:"ready"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Checks    []HealthCheck `json:"checks"`
+}
+
+var (
+	healthMu     sync.RWMutex
+	healthReport *HealthReport
+	healthState  = map[string]bool{} //上一次的检查结果，状态变化时记录日志
+
+	healthLoopMu   sync.Mutex
+	healthLoopStop chan struct{}
+	healthLoopDone chan struct{}
+
+	healthShutdown int32 //Shutdown开始后就绪检查失败，使负载均衡不再转发请求
+)
+
+//开始定期检查DBMapPool、GORMMapPool和redis的全部连接池，先同步检查一次
+func StartHealthCheck() {
+	healthLoopMu.Lock()
+	defer healthLoopMu.Unlock()
+	if healthLoopStop != nil {
+		return
+	}
+	atomic.StoreInt32(&healthShutdown, 0)
+	CheckHealth(context.Background())
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func(interval time.Duration) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				CheckHealth(context.Background())
+			}
+		}
+	}(healthCheckInterval())
+	healthLoopStop, healthLoopDone = stop, done
+}
+
+//停止定期检查
+func StopHealthCheck() {
+	healthLoopMu.Lock()
+	defer healthLoopMu.Unlock()
+	if healthLoopStop == nil {
+		return
+	}
+	close(healthLoopStop)
+	<-healthLoopDone
+	healthLoopStop, healthLoopDone = nil, nil
+}
+
+func healthCheckInterval() time.Duration {
+	if HealthCheckInterval <= 0 {
+		return 10 * time.Second
+	}
+	return HealthCheckInterval
+}
+
+//立即检查全部连接池并更新GetHealth的结果
+func CheckHealth(ctx context.Context) HealthReport {
+	type target struct {
+		name  string
+		check func(ctx context.Context) (interface{}, error)
+	}
+	targets := []target{}
+	for name, db := range DBMapPool {
+		db := db
+		targets = append(targets, target{"mysql." + name, func(ctx context.Context) (interface{}, error) {
+			return db.Stats(), db.PingContext(ctx)
+		}})
+	}
+	for name, db := range GORMMapPool {
+		sqlDB := db.DB()
+		targets = append(targets, target{"gorm." + name, func(ctx context.Context) (interface{}, error) {
+			return sqlDB.Stats(), sqlDB.PingContext(ctx)
+		}})
+	}
+	if ConfRedisMap != nil {
+		for name := range ConfRedisMap.List {
+			name := name
+			targets = append(targets, target{"redis." + name, func(ctx context.Context) (interface{}, error) {
+				return redisHealthStats(name), redisHealthPing(ctx, name)
+			}})
+		}
+	}
+
+	checks := make([]HealthCheck, len(targets))
+	wg := sync.WaitGroup{}
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			checks[i] = runHealthCheck(ctx, t.name, t.check)
+		}(i, t)
+	}
+	wg.Wait()
+	checks = append(checks, dbReplicaHealthChecks()...)
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+
+	report := HealthReport{Live: true, Ready: atomic.LoadInt32(&healthShutdown) == 0, CheckedAt: time.Now(), Checks: checks}
+	for _, c := range checks {
+		if !c.Healthy && !c.Optional {
+			report.Ready = false
+		}
+	}
+	report.Status = HealthStatusOK
+	if !report.Ready {
+		report.Status = HealthStatusFail
+	}
+	healthMu.Lock()
+	healthReport = &report
+	healthMu.Unlock()
+	logHealthChange(checks)
+	return report
+}
+
+//最近一次的检查结果，还未检查过或未启动定期检查且结果超过检查间隔时立即检查
+//定期检查已启动但超过3个检查间隔没有更新时认为检查循环已卡住，Live为false
+func GetHealth() HealthReport {
+	healthLoopMu.Lock()
+	running := healthLoopStop != nil
+	healthLoopMu.Unlock()
+	healthMu.RLock()
+	report := healthReport
+	healthMu.RUnlock()
+	if report == nil || (!running && time.Since(report.CheckedAt) > healthCheckInterval()) {
+		return CheckHealth(context.Background())
+	}
+	res := *report
+	if running && time.Since(res.CheckedAt) > 3*healthCheckInterval() {
+		res.Live = false
+	}
+	if atomic.LoadInt32(&healthShutdown) != 0 {
+		res.Ready = false
+	}
+	if !res.Live || !res.Ready {
+		res.Status = HealthStatusFail
+	}
+	return res
+}
+
+//健康检查的http handler，返回HealthReport的json
+//路径以/live、/livez、/healthz结尾或参数probe=live时为存活检查，否则为就绪检查，失败时返回503
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := GetHealth()
+		ok := report.Ready && report.Live
+		path := strings.TrimRight(r.URL.Path, "/")
+		if r.URL.Query().Get("probe") == "live" || strings.HasSuffix(path, "/live") ||
+			strings.HasSuffix(path, "/livez") || strings.HasSuffix(path, "/healthz") {
+			ok = report.Live
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+//全部database/sql连接池的统计信息，从库为"配置名#序号"
+func DBPoolStats() map[string]sql.DBStats {
+	stats := map[string]sql.DBStats{}
+	for name, db := range DBMapPool {
+		stats[name] = db.Stats()
+	}
+	dbClusterMu.RLock()
+	defer dbClusterMu.RUnlock()
+	for _, c := range dbClusterMap {
+		for _, r := range c.replicas {
+			stats[r.name] = r.db.Stats()
+		}
+	}
+	return stats
+}
+
+//全部gorm连接池的统计信息
+func GormPoolStats() map[string]sql.DBStats {
+	stats := map[string]sql.DBStats{}
+	for name, db := range GORMMapPool {
+		stats[name] = db.DB().Stats()
+	}
+	return stats
+}
+
+func runHealthCheck(ctx context.Context, name string, check func(ctx context.Context) (interface{}, error)) HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+	defer cancel()
+	startExecTime := time.Now()
+	stats, err := check(ctx)
+	endExecTime := time.Now()
+	res := HealthCheck{
+		Name:      name,
+		Healthy:   err == nil,
+		ProcTime:  fmt.Sprintf("%fs", endExecTime.Sub(startExecTime).Seconds()),
+		CheckedAt: endExecTime,
+		Stats:     stats,
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+//从库的状态由从库健康检查维护，这里只汇总
+func dbReplicaHealthChecks() []HealthCheck {
+	dbClusterMu.RLock()
+	defer dbClusterMu.RUnlock()
+	checks := []HealthCheck{}
+	for _, c := range dbClusterMap {
+		for _, r := range c.replicas {
+			check := HealthCheck{
+				Name:      "mysql." + r.name,
+				Healthy:   r.isHealthy(),
+				Optional:  true,
+				CheckedAt: time.Now(),
+				Stats:     r.db.Stats(),
+			}
+			if !check.Healthy {
+				check.Error = "replica ejected"
+				if lag := atomic.LoadInt64(&r.lag); lag >= 0 {
+					check.Error = fmt.Sprintf("replica ejected, lag %ds", lag)
+				}
+			}
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+//redis的PING没有超时参数，超时后放弃等待
+func redisHealthPing(ctx context.Context, name string) error {
+	done := make(chan error, 1)
+	go func() {
+		c, err := RedisConnFactory(name)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		_, err = c.Do("PING")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.New("redis ping timeout")
+	}
+}
+
+//单个redis配置的连接池统计，cluster模式为各节点之和
+func redisHealthStats(name string) interface{} {
+	if pool, ok := RedisMapPool[name]; ok {
+		return pool.Stats()
+	}
+	if cluster, ok := redisClusterMap[name]; ok {
+		total := redis.PoolStats{}
+		for _, stat := range cluster.Stats() {
+			total.ActiveCount += stat.ActiveCount
+			total.IdleCount += stat.IdleCount
+			total.WaitCount += stat.WaitCount
+			total.WaitDuration += stat.WaitDuration
+		}
+		return total
+	}
+	return nil
+}
+
+//连接池状态变化时记录日志，从库的状态变化由从库健康检查记录
+func logHealthChange(checks []HealthCheck) {
+	healthMu.Lock()
+	changed := []HealthCheck{}
+	for _, c := range checks {
+		if c.Optional {
+			continue
+		}
+		last, ok := healthState[c.Name]
+		healthState[c.Name] = c.Healthy
+		if (!ok && !c.Healthy) || (ok && last != c.Healthy) {
+			changed = append(changed, c)
+		}
+	}
+	healthMu.Unlock()
+	trace := NewTrace()
+	for _, c := range changed {
+		failedTag, successTag := DLTagMysqlFailed, DLTagMysqlSuccess
+		if strings.HasPrefix(c.Name, "redis.") {
+			failedTag, successTag = DLTagRedisFailed, DLTagredisSuccess
+		}
+		m := map[string]interface{}{
+			"msg":       "health check",
+			"pool":      c.Name,
+			"healthy":   c.Healthy,
+			"proc_time": c.ProcTime,
+		}
+		if !c.Healthy {
+			m["err"] = c.Error
+			Log.TagWarn(trace, failedTag, m)
+			continue
+		}
+		Log.TagInfo(trace, successTag, m)
+	}
+}
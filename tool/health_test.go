@@ -0,0 +1,136 @@
+package tool
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/e421083458/gorm"
+)
+
+func TestHealthHandler(t *testing.T) {
+	oldDB, oldGorm, oldRedisConf := DBMapPool, GORMMapPool, ConfRedisMap
+	defer func() {
+		DBMapPool, GORMMapPool, ConfRedisMap = oldDB, oldGorm, oldRedisConf
+		healthMu.Lock()
+		healthReport = nil
+		healthMu.Unlock()
+	}()
+	DBMapPool, GORMMapPool = map[string]*sql.DB{}, map[string]*gorm.DB{}
+	newFakeDBPool(t, "health_test", func(query string, args []driver.Value) fakeDBResult {
+		return fakeDBResult{}
+	})
+	srv := newFakeRedisServer(t, func(conn *fakeRedisConn, args []string) string {
+		return "+PONG\r\n"
+	})
+	defer srv.Close()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{
+		"ok":   {ProxyList: []string{srv.Addr()}},
+		"down": {ProxyList: []string{"127.0.0.1:1"}},
+	}}
+
+	probe := func(path string) (int, HealthReport) {
+		w := httptest.NewRecorder()
+		HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		report := HealthReport{}
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, report
+	}
+
+	report := CheckHealth(context.Background())
+	if report.Ready || len(report.Checks) != 3 {
+		t.Fatalf("report %+v", report)
+	}
+	for _, c := range report.Checks {
+		if c.Healthy != (c.Name != "redis.down") || c.Name == "mysql.health_test" && c.Stats == nil {
+			t.Fatalf("check %+v", c)
+		}
+	}
+	if code, r := probe("/health/ready"); code != http.StatusServiceUnavailable || r.Status != HealthStatusFail {
+		t.Fatalf("ready probe %d %+v", code, r)
+	}
+	if code, _ := probe("/health/live"); code != http.StatusOK {
+		t.Fatalf("live probe %d", code)
+	}
+
+	delete(ConfRedisMap.List, "down")
+	CheckHealth(context.Background())
+	if code, r := probe("/health/ready"); code != http.StatusOK || r.Status != HealthStatusOK {
+		t.Fatalf("ready probe %d %+v", code, r)
+	}
+
+	//关闭过程中就绪检查失败，存活检查不受影响
+	atomic.StoreInt32(&healthShutdown, 1)
+	defer atomic.StoreInt32(&healthShutdown, 0)
+	if code, _ := probe("/health/ready"); code != http.StatusServiceUnavailable {
+		t.Fatalf("ready probe during shutdown %d", code)
+	}
+	if code, _ := probe("/health?probe=live"); code != http.StatusOK {
+		t.Fatalf("live probe during shutdown %d", code)
+	}
+}
+
+func TestHealthCheckLoop(t *testing.T) {
+	oldDB, oldGorm, oldRedisConf, oldInterval := DBMapPool, GORMMapPool, ConfRedisMap, HealthCheckInterval
+	moduleMu.Lock()
+	oldMysql := moduleMap["mysql"]
+	moduleMu.Unlock()
+	defer func() {
+		DBMapPool, GORMMapPool, ConfRedisMap, HealthCheckInterval = oldDB, oldGorm, oldRedisConf, oldInterval
+		moduleMu.Lock()
+		moduleMap["mysql"] = oldMysql
+		moduleMu.Unlock()
+		healthMu.Lock()
+		healthReport = nil
+		healthMu.Unlock()
+	}()
+	DBMapPool, GORMMapPool, ConfRedisMap = map[string]*sql.DB{}, map[string]*gorm.DB{}, nil
+	HealthCheckInterval = 20 * time.Millisecond
+	ok := func(query string, args []driver.Value) fakeDBResult { return fakeDBResult{} }
+	newFakeDBPool(t, "loop_a", ok)
+
+	//未启动定期检查时，结果超过检查间隔后重新检查
+	if report := GetHealth(); len(report.Checks) != 1 {
+		t.Fatalf("report %+v", report)
+	}
+	newFakeDBPool(t, "loop_b", ok)
+	if report := GetHealth(); len(report.Checks) != 1 {
+		t.Fatalf("fresh report should be cached, got %+v", report)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if report := GetHealth(); len(report.Checks) != 2 {
+		t.Fatalf("stale report should be refreshed, got %+v", report)
+	}
+
+	//mysql模块初始化后开始定期检查，销毁模块前停止
+	var runningOnDestroy bool
+	registerModule("mysql", nil, func() error { return nil }, func() error {
+		healthLoopMu.Lock()
+		runningOnDestroy = healthLoopStop != nil
+		healthLoopMu.Unlock()
+		return nil
+	})
+	if err := initModules([]string{"mysql"}); err != nil {
+		t.Fatal(err)
+	}
+	healthLoopMu.Lock()
+	running := healthLoopStop != nil
+	healthLoopMu.Unlock()
+	if !running {
+		t.Fatal("health check loop should be started after mysql module init")
+	}
+	if err := destroyResources(); err != nil {
+		t.Fatal(err)
+	}
+	if runningOnDestroy {
+		t.Fatal("health check loop should be stopped before modules are destroyed")
+	}
+}
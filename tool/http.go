@@ -0,0 +1,261 @@
+package tool
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lib/tool/metrics"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//日志及错误中记录的body最大长度
+const httpLogBodyLimit = 1024
+
+//非2xx应答对应的错误
+type HttpError struct {
+	Method     string
+	Url        string
+	StatusCode int
+	Status     string
+	Body       string //已截断
+}
+
+func (e *HttpError) Error() string {
+	return fmt.Sprintf("http %s %s failed, status:%d, body:%s", e.Method, e.Url, e.StatusCode, e.Body)
+}
+
+//通用请求：支持任意method及流式body，logArgs仅用于日志记录
+func httpDo(trace *TraceContext, method string, urlString string, body io.Reader, logArgs interface{}, msTimeout int, header http.Header, contentType string) (resp *http.Response, respBody []byte, err error) {
+	startTime := time.Now().UnixNano()
+	defer func() {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		metrics.ObserveHTTPRequest(httpUpstream(urlString), method, status, err, time.Duration(time.Now().UnixNano()-startTime))
+	}()
+	client := http.Client{
+		Timeout: time.Duration(msTimeout) * time.Millisecond,
+	}
+	req, err := http.NewRequest(method, urlString, body)
+	if err != nil {
+		Log.TagWarn(trace, DLTagHTTPFailed, map[string]interface{}{
+			"url":       urlString,
+			"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9, //1.0e9 10^9
+			"method":    method,
+			"args":      logArgs,
+			"err":       err.Error(),
+		})
+		return nil, nil, err
+	}
+	if len(header) > 0 {
+		req.Header = header
+	}
+	//添加trace
+	req = addTrace2Header(req, trace)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		Log.TagWarn(trace, DLTagHTTPFailed, map[string]interface{}{
+			"url":       urlString,
+			"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
+			"method":    method,
+			"args":      logArgs,
+			"err":       err.Error(),
+		})
+		return nil, nil, err
+	}
+	//执行成功
+	defer resp.Body.Close()
+	respBody, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		Log.TagWarn(trace, DLTagHTTPFailed, map[string]interface{}{
+			"url":       urlString,
+			"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
+			"method":    method,
+			"args":      logArgs,
+			"status":    resp.StatusCode,
+			"err":       err.Error(),
+			"result":    Substr(string(respBody), 0, httpLogBodyLimit),
+		})
+		return resp, respBody, err
+	}
+	m := map[string]interface{}{
+		"url":       urlString,
+		"proc_time": float32(time.Now().UnixNano()-startTime) / 1.0e9,
+		"method":    method,
+		"args":      logArgs,
+		"status":    resp.StatusCode,
+		"result":    Substr(string(respBody), 0, httpLogBodyLimit),
+	}
+	//非2xx应答记为失败
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		Log.TagWarn(trace, DLTagHTTPFailed, m)
+		return resp, respBody, nil
+	}
+	//读取成功
+	Log.TagInfo(trace, DLTagHTTPSuccess, m)
+	return resp, respBody, nil
+}
+
+//监控指标中的upstream，为url的host
+func httpUpstream(urlString string) string {
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+//通用请求：body可以为任意io.Reader（流式上传时不记录body）
+func HttpDo(trace *TraceContext, method string, urlString string, body io.Reader, msTimeout int, header http.Header, contentType string) (*http.Response, []byte, error) {
+	return httpDo(trace, method, urlString, body, "<stream>", msTimeout, header, contentType)
+}
+
+//GET请求
+func HttpGET(trace *TraceContext, urlString string, urlParams url.Values, msTimeout int, header http.Header) (*http.Response, []byte, error) {
+	urlString = AddGetDataToUrl(urlString, urlParams)
+	return httpDo(trace, http.MethodGet, urlString, nil, urlParams, msTimeout, header, "")
+}
+
+//HEAD请求
+func HttpHEAD(trace *TraceContext, urlString string, urlParams url.Values, msTimeout int, header http.Header) (*http.Response, error) {
+	urlString = AddGetDataToUrl(urlString, urlParams)
+	resp, _, err := httpDo(trace, http.MethodHead, urlString, nil, urlParams, msTimeout, header, "")
+	return resp, err
+}
+
+//DELETE请求
+func HttpDELETE(trace *TraceContext, urlString string, urlParams url.Values, msTimeout int, header http.Header) (*http.Response, []byte, error) {
+	urlString = AddGetDataToUrl(urlString, urlParams)
+	return httpDo(trace, http.MethodDelete, urlString, nil, urlParams, msTimeout, header, "")
+}
+
+//POST请求
+func HttpPOST(trace *TraceContext, urlString string, urlParams url.Values, msTimeout int, header http.Header, contextType string) (*http.Response, []byte, error) {
+	if contextType == "" {
+		contextType = "application/x-www-form-urlencoded"
+	}
+	urlParamEncode := urlParams.Encode()
+	return httpDo(trace, http.MethodPost, urlString, strings.NewReader(urlParamEncode),
+		Substr(urlParamEncode, 0, httpLogBodyLimit), msTimeout, header, contextType)
+}
+
+//PUT请求
+func HttpPUT(trace *TraceContext, urlString string, body io.Reader, msTimeout int, header http.Header, contextType string) (*http.Response, []byte, error) {
+	return HttpDo(trace, http.MethodPut, urlString, body, msTimeout, header, contextType)
+}
+
+//PATCH请求
+func HttpPATCH(trace *TraceContext, urlString string, body io.Reader, msTimeout int, header http.Header, contextType string) (*http.Response, []byte, error) {
+	return HttpDo(trace, http.MethodPatch, urlString, body, msTimeout, header, contextType)
+}
+
+//JSON POST请求
+func HttpJSON(trace *TraceContext, urlString string, jsonContent string, msTimeout int, header http.Header) (*http.Response, []byte, error) {
+	return httpDo(trace, http.MethodPost, urlString, strings.NewReader(jsonContent),
+		Substr(jsonContent, 0, httpLogBodyLimit), msTimeout, header, "application/json")
+}
+
+//JSON请求：将reqData序列化为body，并将2xx应答反序列化到respData
+//reqData为nil时不发送body，respData为nil时忽略应答；非2xx应答返回*HttpError
+func HttpJSONDo(trace *TraceContext, method string, urlString string, reqData interface{}, respData interface{}, msTimeout int, header http.Header) error {
+	var body io.Reader
+	var logArgs string
+	contentType := ""
+	if reqData != nil {
+		bts, err := json.Marshal(reqData)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(bts)
+		logArgs = Substr(string(bts), 0, httpLogBodyLimit)
+		contentType = "application/json"
+	}
+	resp, respBody, err := httpDo(trace, method, urlString, body, logArgs, msTimeout, header, contentType)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &HttpError{
+			Method:     method,
+			Url:        urlString,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       Substr(string(respBody), 0, httpLogBodyLimit),
+		}
+	}
+	if respData == nil || len(respBody) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, respData); err != nil {
+		return fmt.Errorf("unmarshal response of %s %s failed,err:%v", method, urlString, err)
+	}
+	return nil
+}
+
+//multipart文件上传，文件内容以流的方式写入请求body
+func HttpUpload(trace *TraceContext, urlString string, fields url.Values, fieldName string, fileName string, file io.Reader, msTimeout int, header http.Header) (*http.Response, []byte, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		var err error
+		defer func() {
+			if err == nil {
+				err = mw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		for key, values := range fields {
+			for _, value := range values {
+				if err = mw.WriteField(key, value); err != nil {
+					return
+				}
+			}
+		}
+		var part io.Writer
+		if part, err = mw.CreateFormFile(fieldName, fileName); err != nil {
+			return
+		}
+		_, err = io.Copy(part, file)
+	}()
+	resp, body, err := httpDo(trace, http.MethodPost, urlString, pr, map[string]interface{}{
+		"fields": fields,
+		"file":   fileName,
+	}, msTimeout, header, mw.FormDataContentType())
+	//请求提前结束时，终止写入协程
+	pr.CloseWithError(io.ErrClosedPipe)
+	return resp, body, err
+}
+
+//将受到的数据组成链接：a=%2A&b=%2A
+func AddGetDataToUrl(urlString string, data url.Values) string {
+	if strings.Contains(urlString, "?") {
+		urlString = urlString + "&"
+	} else {
+		urlString = urlString + "?"
+	}
+	return fmt.Sprintf("%s%s", urlString, data.Encode())
+}
+
+//将traceId和cSpanId添加到header中
+func addTrace2Header(request *http.Request, trace *TraceContext) *http.Request {
+	traceId := trace.TraceId
+	cSpanId := NewSpanId()
+	if traceId != "" {
+		request.Header.Set("didi-header-rid", traceId)
+	}
+	if cSpanId != "" {
+		request.Header.Set("didi-header-spanid", cSpanId)
+	}
+	trace.CSpanId = cSpanId
+	return request
+}
@@ -0,0 +1,60 @@
+package tool
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHttpJSONDo(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		req := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string]string{"echo": req["name"]})
+	}))
+	defer ts.Close()
+
+	resp := map[string]string{}
+	if err := HttpJSONDo(NewTrace(), http.MethodPut, ts.URL, map[string]string{"name": "lib"}, &resp, 1000, nil); err != nil {
+		t.Fatal(err)
+	}
+	if resp["echo"] != "lib" {
+		t.Fatalf("unexpected response %v", resp)
+	}
+
+	err := HttpJSONDo(NewTrace(), http.MethodPost, ts.URL, nil, nil, 1000, nil)
+	httpErr, ok := err.(*HttpError)
+	if !ok || httpErr.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected HttpError with status 405, got %v", err)
+	}
+}
+
+func TestHttpUpload(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bts, _ := ioutil.ReadAll(file)
+		w.Write([]byte(r.FormValue("kind") + ":" + header.Filename + ":" + string(bts)))
+	}))
+	defer ts.Close()
+
+	_, body, err := HttpUpload(NewTrace(), ts.URL, url.Values{"kind": {"text"}}, "file", "a.txt",
+		strings.NewReader("hello"), 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "text:a.txt:hello" {
+		t.Fatalf("unexpected body %s", body)
+	}
+}
@@ -0,0 +1,179 @@
+package tool
+
+import (
+	"context"
+	"fmt"
+	dlog "lib/log"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//关闭时的全局超时时间默认值
+const shutdownTimeoutDefault = 10 * time.Second
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []shutdownHook
+)
+
+//注册关闭钩子，Shutdown时按注册的相反顺序执行，ctx在全局超时后取消
+func OnShutdown(name string, fn func(ctx context.Context) error) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+//超时未完成的关闭钩子
+type ShutdownTimeoutError struct {
+	Hooks []string
+}
+
+func (e *ShutdownTimeoutError) Error() string {
+	return "shutdown hooks timed out: " + strings.Join(e.Hooks, ", ")
+}
+
+//运行服务：fn的ctx在收到SIGINT/SIGTERM时取消，fn返回后在timeout内执行关闭钩子并销毁资源
+//fn为nil时一直等待信号，timeout<=0时使用默认值10s
+func Run(fn func(ctx context.Context) error, timeout time.Duration) error {
+	//同一进程中再次Run时，清除上次Shutdown设置的关闭状态
+	atomic.StoreInt32(&healthShutdown, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	finished := make(chan struct{})
+	defer func() {
+		signal.Stop(sigCh)
+		close(finished)
+	}()
+	go func() {
+		select {
+		case sig := <-sigCh:
+			log.Printf("[INFO] %s\n", " received signal "+sig.String()+", shutting down.")
+			cancel()
+		case <-finished:
+			return
+		}
+		//关闭过程中再次收到信号时直接退出
+		select {
+		case sig := <-sigCh:
+			log.Printf("[ERROR] %s\n", " received signal "+sig.String()+" again, exit immediately.")
+			os.Exit(1)
+		case <-finished:
+		}
+	}()
+
+	var runErr error
+	if fn != nil {
+		runErr = fn(ctx)
+	} else {
+		<-ctx.Done()
+	}
+	cancel()
+
+	errs := ModuleErrors{}
+	if runErr != nil {
+		errs = append(errs, runErr)
+	}
+	if err := Shutdown(timeout); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//在timeout内按相反顺序执行关闭钩子，然后销毁模块、关闭连接池并刷新日志
+//超时未完成以及因超时未执行的钩子通过*ShutdownTimeoutError返回
+func Shutdown(timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = shutdownTimeoutDefault
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	//先使就绪检查失败，再执行关闭钩子
+	atomic.StoreInt32(&healthShutdown, 1)
+
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownMu.Unlock()
+
+	errs := ModuleErrors{}
+	timedOut := []string{}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hook := hooks[i]
+		if ctx.Err() != nil {
+			timedOut = append(timedOut, hook.name)
+			continue
+		}
+		startTime := time.Now()
+		done := make(chan error, 1)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					done <- fmt.Errorf("panic: %v", r)
+				}
+			}()
+			done <- hook.fn(ctx)
+		}()
+		select {
+		case err := <-done:
+			procTime := time.Since(startTime).Seconds()
+			if err != nil {
+				log.Printf("[ERROR] shutdown hook %s failed, proc_time=%fs, err=%s\n", hook.name, procTime, err)
+				errs = append(errs, fmt.Errorf("shutdown hook %s: %s", hook.name, err))
+				continue
+			}
+			log.Printf("[INFO] shutdown hook %s success, proc_time=%fs\n", hook.name, procTime)
+		case <-ctx.Done():
+			timedOut = append(timedOut, hook.name)
+		}
+	}
+	if len(timedOut) > 0 {
+		timeoutErr := &ShutdownTimeoutError{Hooks: timedOut}
+		log.Printf("[ERROR] %s\n", " "+timeoutErr.Error())
+		errs = append(errs, timeoutErr)
+	}
+
+	if err := destroyResources(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//销毁InitModule初始化的模块，未通过InitModule初始化的连接池和日志也一并关闭
+func destroyResources() error {
+	logInited := moduleIsInited("log")
+	mysqlInited := moduleIsInited("mysql")
+	redisInited := moduleIsInited("redis")
+	//先停止健康检查，避免检查已关闭的连接池
+	StopHealthCheck()
+	err := destroyModules()
+	if !mysqlInited {
+		CloseDB()
+	}
+	if !redisInited {
+		CloseRedisPool()
+	}
+	if !logInited {
+		dlog.Close()
+	}
+	return err
+}
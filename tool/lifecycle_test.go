@@ -0,0 +1,50 @@
+package tool
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownTimeout(t *testing.T) {
+	defer atomic.StoreInt32(&healthShutdown, 0)
+	order := []string{}
+	OnShutdown("first", func(ctx context.Context) error {
+		order = append(order, "first")
+		return nil
+	})
+	OnShutdown("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	OnShutdown("last", func(ctx context.Context) error {
+		order = append(order, "last")
+		return nil
+	})
+
+	err := Shutdown(100 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "shutdown hooks timed out: slow, first") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if strings.Join(order, ",") != "last" {
+		t.Fatalf("unexpected hook order %v", order)
+	}
+}
+
+func TestRunTwice(t *testing.T) {
+	defer atomic.StoreInt32(&healthShutdown, 0)
+	for i := 0; i < 2; i++ {
+		err := Run(func(ctx context.Context) error {
+			if atomic.LoadInt32(&healthShutdown) != 0 {
+				return errors.New("process reported as shutting down")
+			}
+			return nil
+		}, time.Second)
+		if err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+}
@@ -132,6 +132,10 @@ func parseParams(m map[string]interface{}) string {
 		if _key == "dltag" {
 			continue
 		}
+		//密码、DSN等配置项脱敏
+		if isSensitiveConfKey(_key) {
+			_val = RedactConf(_key, _val)
+		}
 		dltag = dltag + "||" + fmt.Sprintf("%v=%+v", _key, _val)
 	}
 	dltag = strings.Trim(fmt.Sprintf("%q", dltag), "\"")
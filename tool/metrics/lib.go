@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	dlog "lib/log"
+)
+
+//请求结果标签的取值
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+//lib中http、mysql、redis辅助函数的指标
+var (
+	HTTPRequests = NewCounterVec("lib_http_client_requests_total",
+		"HTTP client requests by upstream host, method and status code.", "upstream", "method", "status")
+	HTTPRequestDuration = NewHistogramVec("lib_http_client_request_duration_seconds",
+		"HTTP client request latency in seconds.", DefBuckets, "upstream", "method")
+
+	MySQLQueries = NewCounterVec("lib_mysql_queries_total",
+		"MySQL statements by pool and result.", "pool", "result")
+	MySQLQueryDuration = NewHistogramVec("lib_mysql_query_duration_seconds",
+		"MySQL statement latency in seconds.", DefBuckets, "pool")
+
+	RedisCommands = NewCounterVec("lib_redis_commands_total",
+		"Redis commands by command name and result.", "command", "result")
+	RedisCommandDuration = NewHistogramVec("lib_redis_command_duration_seconds",
+		"Redis command latency in seconds.", DefBuckets, "command")
+)
+
+func init() {
+	NewFunc("lib_log_records_total", "Log records accepted by the log tunnel, by level.", TypeCounter,
+		[]string{"level"}, func(emit func(value float64, labelValues ...string)) {
+			stats := dlog.GetStats()
+			for _, flag := range dlog.LEVEL_FLAGS {
+				level := strings.ToLower(flag)
+				emit(float64(stats.Records[level]), level)
+			}
+		})
+	NewFunc("lib_log_dropped_records_total", "Log records that failed to write to at least one log writer.", TypeCounter,
+		nil, func(emit func(value float64, labelValues ...string)) {
+			emit(float64(dlog.GetStats().Dropped))
+		})
+	NewFunc("lib_log_queue_length", "Log records waiting in the log tunnel.", TypeGauge,
+		nil, func(emit func(value float64, labelValues ...string)) {
+			emit(float64(dlog.GetStats().Queued))
+		})
+}
+
+func result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+//记录一次http请求，没有响应时status为"error"
+func ObserveHTTPRequest(upstream, method string, status int, err error, cost time.Duration) {
+	statusLabel := "error"
+	if status > 0 {
+		statusLabel = strconv.Itoa(status)
+	}
+	method = strings.ToUpper(method)
+	HTTPRequests.WithLabelValues(upstream, method, statusLabel).Inc()
+	HTTPRequestDuration.WithLabelValues(upstream, method).Observe(cost.Seconds())
+}
+
+//记录一次MySQL语句
+func ObserveMySQLQuery(pool string, err error, cost time.Duration) {
+	MySQLQueries.WithLabelValues(pool, result(err)).Inc()
+	MySQLQueryDuration.WithLabelValues(pool).Observe(cost.Seconds())
+}
+
+//记录一次redis命令，pipeline、事务整体记录为PIPELINE、MULTI
+func ObserveRedisCommand(command string, err error, cost time.Duration) {
+	command = strings.ToUpper(command)
+	RedisCommands.WithLabelValues(command, result(err)).Inc()
+	RedisCommandDuration.WithLabelValues(command).Observe(cost.Seconds())
+}
@@ -0,0 +1,388 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//指标类型
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+//默认的耗时分桶（秒）
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const labelSep = "\xff"
+
+type collector interface {
+	desc() *metricDesc
+	//按Prometheus文本格式写入样本，不包括HELP和TYPE
+	write(w *bufio.Writer)
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *metricDesc) desc() *metricDesc {
+	return d
+}
+
+//指标注册表
+type Registry struct {
+	mu         sync.RWMutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[string]collector{}}
+}
+
+//默认注册表，包级别的New*函数以及Handler使用
+var DefaultRegistry = NewRegistry()
+
+//注册指标，名称重复时panic
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name := c.desc().name
+	if _, ok := r.collectors[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.collectors[name] = c
+}
+
+//按Prometheus文本格式（0.0.4）输出全部指标，按名称排序
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := make([]collector, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		d := c.desc()
+		fmt.Fprintf(bw, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", d.name, d.typ)
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+//输出指标的http handler，用于/metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+//默认注册表的http handler，如 http.Handle("/metrics", metrics.Handler())
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+//计数器，只增不减
+type Counter struct {
+	bits uint64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+//v不能为负数
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	addFloat(&c.bits, v)
+}
+
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+//带标签的计数器
+type CounterVec struct {
+	metricDesc
+	mu     sync.RWMutex
+	values map[string]*labeledCounter
+}
+
+type labeledCounter struct {
+	labelValues []string
+	Counter
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricDesc: metricDesc{name: name, help: help, typ: TypeCounter, labels: labels},
+		values:     map[string]*labeledCounter{},
+	}
+	r.register(c)
+	return c
+}
+
+//在默认注册表中创建带标签的计数器
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return DefaultRegistry.NewCounterVec(name, help, labels...)
+}
+
+//按标签值获取计数器，标签值的数量必须与标签相同
+func (c *CounterVec) WithLabelValues(values ...string) *Counter {
+	key := labelKey(c.name, c.labels, values)
+	c.mu.RLock()
+	v, ok := c.values[key]
+	c.mu.RUnlock()
+	if ok {
+		return &v.Counter
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok = c.values[key]; !ok {
+		v = &labeledCounter{labelValues: append([]string{}, values...)}
+		c.values[key] = v
+	}
+	return &v.Counter
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		writeSample(w, c.name, c.labels, v.labelValues, "", "", v.Value())
+	}
+}
+
+//带标签的直方图
+type HistogramVec struct {
+	metricDesc
+	buckets []float64
+	mu      sync.RWMutex
+	values  map[string]*Histogram
+}
+
+type Histogram struct {
+	labelValues []string
+	buckets     []float64
+	mu          sync.Mutex
+	counts      []uint64 //每个分桶的数量（非累计）
+	sum         float64
+	count       uint64
+}
+
+//buckets为升序的分桶上限，为空时使用DefBuckets
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{
+		metricDesc: metricDesc{name: name, help: help, typ: TypeHistogram, labels: labels},
+		buckets:    buckets,
+		values:     map[string]*Histogram{},
+	}
+	r.register(h)
+	return h
+}
+
+//在默认注册表中创建带标签的直方图
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogramVec(name, help, buckets, labels...)
+}
+
+//按标签值获取直方图，标签值的数量必须与标签相同
+func (h *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	key := labelKey(h.name, h.labels, values)
+	h.mu.RLock()
+	v, ok := h.values[key]
+	h.mu.RUnlock()
+	if ok {
+		return v
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if v, ok = h.values[key]; !ok {
+		v = &Histogram{
+			labelValues: append([]string{}, values...),
+			buckets:     h.buckets,
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = v
+	}
+	return v
+}
+
+func (h *Histogram) Observe(v float64) {
+	idx := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if idx < len(h.counts) {
+		h.counts[idx]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		v.mu.Lock()
+		counts := append([]uint64{}, v.counts...)
+		sum, count := v.sum, v.count
+		v.mu.Unlock()
+		cumulative := uint64(0)
+		for i, upper := range h.buckets {
+			cumulative += counts[i]
+			writeSample(w, h.name+"_bucket", h.labels, v.labelValues, "le", formatFloat(upper), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, v.labelValues, "le", "+Inf", float64(count))
+		writeSample(w, h.name+"_sum", h.labels, v.labelValues, "", "", sum)
+		writeSample(w, h.name+"_count", h.labels, v.labelValues, "", "", float64(count))
+	}
+}
+
+//采集时通过函数获取的指标，如日志统计、连接池状态
+type funcCollector struct {
+	metricDesc
+	fn func(emit func(value float64, labelValues ...string))
+}
+
+//注册采集时调用fn获取样本的指标，typ为TypeCounter或TypeGauge
+//fn中每次调用emit输出一个样本，标签值的数量必须与labels相同
+func (r *Registry) NewFunc(name, help, typ string, labels []string, fn func(emit func(value float64, labelValues ...string))) {
+	r.register(&funcCollector{
+		metricDesc: metricDesc{name: name, help: help, typ: typ, labels: labels},
+		fn:         fn,
+	})
+}
+
+//在默认注册表中注册采集时调用fn获取样本的指标
+func NewFunc(name, help, typ string, labels []string, fn func(emit func(value float64, labelValues ...string))) {
+	DefaultRegistry.NewFunc(name, help, typ, labels, fn)
+}
+
+func (f *funcCollector) write(w *bufio.Writer) {
+	f.fn(func(value float64, labelValues ...string) {
+		checkLabels(f.name, f.labels, labelValues)
+		writeSample(w, f.name, f.labels, labelValues, "", "", value)
+	})
+}
+
+func addFloat(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		if atomic.CompareAndSwapUint64(bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func labelKey(name string, labels, values []string) string {
+	checkLabels(name, labels, values)
+	return strings.Join(values, labelSep)
+}
+
+//标签值的数量与标签不一致时panic
+func checkLabels(name string, labels, values []string) {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", name, len(labels), len(values)))
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]*labeledCounter:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*Histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//写入一个样本，extraName不为空时追加一个标签（直方图的le）
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabel(values[i]))
+			w.WriteByte('"')
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName)
+			w.WriteString(`="`)
+			w.WriteString(extraValue)
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_requests_total", "Requests.\nSecond line.", "path", "code")
+	c.WithLabelValues("/a", "200").Inc()
+	c.WithLabelValues("/a", "200").Add(2)
+	c.WithLabelValues(`/b"\`, "500").Inc()
+	h := r.NewHistogramVec("test_duration_seconds", "Duration.", []float64{1, 0.1}, "path")
+	h.WithLabelValues("/a").Observe(0.05)
+	h.WithLabelValues("/a").Observe(0.5)
+	h.WithLabelValues("/a").Observe(3)
+	r.NewFunc("test_queue_length", "Queue.", TypeGauge, nil, func(emit func(value float64, labelValues ...string)) {
+		emit(7)
+	})
+
+	buf := &bytes.Buffer{}
+	if err := r.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{path="/a",le="0.1"} 1
+test_duration_seconds_bucket{path="/a",le="1"} 2
+test_duration_seconds_bucket{path="/a",le="+Inf"} 3
+test_duration_seconds_sum{path="/a"} 3.55
+test_duration_seconds_count{path="/a"} 3
+# HELP test_queue_length Queue.
+# TYPE test_queue_length gauge
+test_queue_length 7
+# HELP test_requests_total Requests.\nSecond line.
+# TYPE test_requests_total counter
+test_requests_total{path="/a",code="200"} 3
+test_requests_total{path="/b\"\\",code="500"} 1
+`
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestRegistryPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("dup_total", "Dup.", "a")
+	expectPanic(t, "duplicate", func() { r.NewCounterVec("dup_total", "Dup.") })
+	expectPanic(t, "label count", func() { c.WithLabelValues("x", "y") })
+	expectPanic(t, "negative add", func() { c.WithLabelValues("x").Add(-1) })
+}
+
+func expectPanic(t *testing.T, name string, fn func()) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s: expected panic", name)
+		}
+	}()
+	fn()
+}
+
+func TestLibMetrics(t *testing.T) {
+	ObserveMySQLQuery("metrics_test", nil, 20*time.Millisecond)
+	ObserveMySQLQuery("metrics_test", errors.New("boom"), time.Millisecond)
+	ObserveRedisCommand("get", nil, time.Millisecond)
+	ObserveHTTPRequest("example.com", "get", 0, errors.New("timeout"), time.Second)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("content type %s", ct)
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		`lib_mysql_queries_total{pool="metrics_test",result="success"} 1`,
+		`lib_mysql_queries_total{pool="metrics_test",result="failure"} 1`,
+		`lib_mysql_query_duration_seconds_bucket{pool="metrics_test",le="0.025"} 2`,
+		`lib_redis_commands_total{command="GET",result="success"} 1`,
+		`lib_http_client_requests_total{upstream="example.com",method="GET",status="error"} 1`,
+		`lib_log_records_total{level="info"} `,
+		`lib_log_dropped_records_total `,
+		`lib_log_queue_length `,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
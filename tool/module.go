@@ -0,0 +1,228 @@
+package tool
+
+import (
+	"fmt"
+	dlog "lib/log"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//模块：InitModule按依赖顺序初始化，Destroy按相反顺序销毁
+type module struct {
+	name    string
+	deps    []string
+	init    func() error
+	destroy func() error
+	builtin bool //内置模块，不能通过RegisterModule替换
+}
+
+var (
+	moduleMu     sync.Mutex
+	moduleMap    = map[string]*module{}
+	moduleInited []*module //已初始化成功的模块，按初始化顺序
+)
+
+//初始化失败的模块错误汇总
+type ModuleErrors []error
+
+func (e ModuleErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+//注册自定义模块，InitModule的modules中包含name时按依赖顺序调用initFn，Destroy时调用destroyFn
+//deps为依赖的模块，为空时依赖log模块，此时配置目录、base配置和日志均已初始化
+//同名的自定义模块会被覆盖，与内置模块（base、log、mysql、redis、conf_watch）同名时返回错误，不会替换内置模块
+func RegisterModule(name string, initFn func() error, destroyFn func() error, deps ...string) error {
+	if len(deps) == 0 {
+		deps = []string{"log"}
+	}
+	moduleMu.Lock()
+	defer moduleMu.Unlock()
+	if m, ok := moduleMap[name]; ok && m.builtin {
+		log.Printf("[ERROR] module %s is built-in, RegisterModule ignored\n", name)
+		return fmt.Errorf("module %s is built-in and cannot be replaced", name)
+	}
+	moduleMap[name] = &module{name: name, deps: deps, init: initFn, destroy: destroyFn}
+	return nil
+}
+
+//注册模块，同名模块会被覆盖
+func registerModule(name string, deps []string, initFn func() error, destroyFn func() error) {
+	moduleMu.Lock()
+	defer moduleMu.Unlock()
+	moduleMap[name] = &module{name: name, deps: deps, init: initFn, destroy: destroyFn}
+}
+
+//内置模块
+func init() {
+	registerModule("base", nil, initBaseModule, nil)
+	registerModule("log", []string{"base"}, InitLog, func() error {
+		dlog.Close()
+		return nil
+	})
+	registerModule("mysql", []string{"log"}, func() error {
+		return InitDBPool(GetConfPath("mysql_map"))
+	}, CloseDB)
+	registerModule("redis", []string{"log"}, func() error {
+		if err := InitRedisConf(GetConfPath("redis_map")); err != nil {
+			return err
+		}
+		return InitRedisPool()
+	}, CloseRedisPool)
+	//配置热更新，按需在modules中加入
+	registerModule("conf_watch", []string{"log"}, WatchConf, StopWatchConf)
+	for _, m := range moduleMap {
+		m.builtin = true
+	}
+}
+
+//加载base配置并设置时区
+func initBaseModule() error {
+	if err := LoadBaseConf(GetConfPath("base")); err != nil {
+		return err
+	}
+	location, err := time.LoadLocation(ConfBase.TimeLocation)
+	if err != nil {
+		return err
+	}
+	TimeLocation = location
+	return nil
+}
+
+//按依赖关系排序：依赖的模块排在前面，其余按names的顺序
+//names中未包含的依赖会被自动加入
+func resolveModules(names []string) ([]*module, error) {
+	moduleMu.Lock()
+	defer moduleMu.Unlock()
+	ordered := []*module{}
+	done := map[string]bool{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		m, ok := moduleMap[name]
+		if !ok {
+			if len(path) > 0 {
+				return fmt.Errorf("module %s: unknown dependency %s", path[len(path)-1], name)
+			}
+			return fmt.Errorf("unknown module %s", name)
+		}
+		if InArrayString(name, path) {
+			return fmt.Errorf("module dependency cycle: %s -> %s", strings.Join(path, " -> "), name)
+		}
+		if done[name] {
+			return nil
+		}
+		for _, dep := range m.deps {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		done[name] = true
+		ordered = append(ordered, m)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+//依次初始化模块，依赖初始化失败的模块会被跳过，返回全部错误
+//已初始化的模块不会重复初始化，重复调用InitModule时只初始化新增的模块
+//mysql或redis模块已初始化时，全部模块初始化完成后开始定期健康检查
+func initModules(names []string) error {
+	ordered, err := resolveModules(names)
+	if err != nil {
+		return err
+	}
+	//初始化期间暂停健康检查，避免检查循环读取正在写入的连接池
+	StopHealthCheck()
+	errs := ModuleErrors{}
+	failed := map[string]bool{}
+	for _, m := range ordered {
+		if moduleIsInited(m.name) {
+			continue
+		}
+		skip := ""
+		for _, dep := range m.deps {
+			if failed[dep] {
+				skip = dep
+				break
+			}
+		}
+		if skip != "" {
+			failed[m.name] = true
+			errs = append(errs, fmt.Errorf("module %s: skipped, dependency %s failed", m.name, skip))
+			continue
+		}
+		if m.init != nil {
+			startTime := time.Now()
+			err := m.init()
+			procTime := time.Since(startTime).Seconds()
+			if err != nil {
+				log.Printf("[ERROR] module %s init failed, proc_time=%fs, err=%s\n", m.name, procTime, err)
+				failed[m.name] = true
+				errs = append(errs, errors.Wrap(err, "module "+m.name))
+				continue
+			}
+			log.Printf("[INFO] module %s init success, proc_time=%fs\n", m.name, procTime)
+		}
+		moduleMu.Lock()
+		moduleInited = append(moduleInited, m)
+		moduleMu.Unlock()
+	}
+	if moduleIsInited("mysql") || moduleIsInited("redis") {
+		StartHealthCheck()
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//模块是否已初始化
+func moduleIsInited(name string) bool {
+	moduleMu.Lock()
+	defer moduleMu.Unlock()
+	for _, m := range moduleInited {
+		if m.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+//按初始化的相反顺序销毁模块
+func destroyModules() error {
+	moduleMu.Lock()
+	inited := moduleInited
+	moduleInited = nil
+	moduleMu.Unlock()
+	errs := ModuleErrors{}
+	for i := len(inited) - 1; i >= 0; i-- {
+		m := inited[i]
+		if m.destroy == nil {
+			continue
+		}
+		startTime := time.Now()
+		if err := m.destroy(); err != nil {
+			log.Printf("[ERROR] module %s destroy failed, err=%s\n", m.name, err)
+			errs = append(errs, errors.Wrap(err, "module "+m.name))
+			continue
+		}
+		log.Printf("[INFO] module %s destroy success, proc_time=%fs\n", m.name, time.Since(startTime).Seconds())
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
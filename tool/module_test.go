@@ -0,0 +1,89 @@
+package tool
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestInitModulesOrder(t *testing.T) {
+	order := []string{}
+	record := func(name string, err error) func() error {
+		return func() error {
+			order = append(order, name)
+			return err
+		}
+	}
+	registerModule("test_c", []string{"test_b"}, record("init c", nil), record("destroy c", nil))
+	registerModule("test_a", nil, record("init a", nil), record("destroy a", nil))
+	registerModule("test_b", []string{"test_a"}, record("init b", nil), record("destroy b", nil))
+	registerModule("test_d", []string{"test_a"}, record("init d", errors.New("boom")), nil)
+	registerModule("test_e", []string{"test_d"}, record("init e", nil), nil)
+
+	err := initModules([]string{"test_c", "test_e"})
+	if err == nil || !strings.Contains(err.Error(), "boom") || !strings.Contains(err.Error(), "test_e: skipped") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := destroyModules(); err != nil {
+		t.Fatal(err)
+	}
+	want := "init a,init b,init c,init d,destroy c,destroy b,destroy a"
+	if got := strings.Join(order, ","); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestInitModulesCycle(t *testing.T) {
+	registerModule("test_x", []string{"test_y"}, nil, nil)
+	registerModule("test_y", []string{"test_x"}, nil, nil)
+	if err := initModules([]string{"test_x"}); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("expected cycle error, got %v", err)
+	}
+	if err := initModules([]string{"test_missing"}); err == nil {
+		t.Fatal("expected unknown module error")
+	}
+}
+
+func TestRegisterModuleDefaultDeps(t *testing.T) {
+	RegisterModule("test_custom", nil, nil)
+	if deps := moduleMap["test_custom"].deps; len(deps) != 1 || deps[0] != "log" {
+		t.Fatalf("custom module should depend on log, got %v", deps)
+	}
+	RegisterModule("test_custom", nil, nil, "test_a")
+	if deps := moduleMap["test_custom"].deps; len(deps) != 1 || deps[0] != "test_a" {
+		t.Fatalf("unexpected deps %v", deps)
+	}
+	//内置模块不能被替换
+	for _, name := range []string{"base", "log", "mysql", "redis", "conf_watch"} {
+		builtin := moduleMap[name]
+		if err := RegisterModule(name, nil, nil); err == nil || moduleMap[name] != builtin {
+			t.Fatalf("built-in module %s should not be replaced, err %v", name, err)
+		}
+	}
+}
+
+func TestInitModulesTwice(t *testing.T) {
+	order := []string{}
+	record := func(name string) func() error {
+		return func() error {
+			order = append(order, name)
+			return nil
+		}
+	}
+	registerModule("test_f", nil, record("init f"), record("destroy f"))
+	registerModule("test_g", []string{"test_f"}, record("init g"), record("destroy g"))
+
+	//重复初始化时只初始化新增的模块
+	for _, names := range [][]string{{"test_f"}, {"test_g"}, {"test_f", "test_g"}} {
+		if err := initModules(names); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := destroyModules(); err != nil {
+		t.Fatal(err)
+	}
+	want := "init f,init g,destroy g,destroy f"
+	if got := strings.Join(order, ","); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 	"unicode"
 )
@@ -24,19 +25,16 @@ func InitDBPool(path string) error {
 	if len(DbConfMap.List) == 0 {
 		fmt.Printf("[INFO]%s%s\n", time.Now().Format(TimeFormat), "  mysql config is empty")
 	}
+	closeDBClusters()
 	DBMapPool = map[string]*sql.DB{}
 	GORMMapPool = map[string]*gorm.DB{}
 
 	//通过获取到的配置设置连接池的信息
 	for confName, DbConf := range DbConfMap.List {
-		dbPool, err := sql.Open("mysql", DbConf.DataSourceName)
+		dbPool, err := openDBPool(DbConf.DataSourceName, DbConf)
 		if err != nil {
 			return err
 		}
-		//设置最 数
-		dbPool.SetMaxOpenConns(DbConf.MaxOpenConn)
-		dbPool.SetMaxIdleConns(DbConf.MaxIdleConn)
-		dbPool.SetConnMaxLifetime(time.Duration(DbConf.MaxConnLifeTime) * time.Second)
 		//探测MySQL是否可以连接
 		err = dbPool.Ping()
 		if err != nil {
@@ -44,21 +42,20 @@ func InitDBPool(path string) error {
 		}
 
 		//gorm连接方式
-		dbGorm, err := gorm.Open("mysql", DbConf.DataSourceName)
+		dbGorm, err := openGormPool(confName, DbConf.DataSourceName, DbConf)
 		if err != nil {
 			return err
 		}
-		//默认使用单个表
-		dbGorm.SingularTable(true)
-		//当打印日志的时候获得上下文
-		dbGorm.LogCtx(true)
-		dbGorm.SetLogger(&MysqlGormLogger{Trace: NewTrace()})
-		dbGorm.DB().SetMaxIdleConns(DbConf.MaxIdleConn)
-		dbGorm.DB().SetMaxOpenConns(DbConf.MaxOpenConn)
-		dbGorm.DB().SetConnMaxLifetime(time.Duration(DbConf.MaxConnLifeTime) * time.Second)
 		DBMapPool[confName] = dbPool
 		GORMMapPool[confName] = dbGorm
+		SetDBSlowThreshold(confName, time.Duration(DbConf.SlowThreshold)*time.Millisecond)
 
+		//从库
+		if len(DbConf.Replicas) > 0 {
+			if err := openDBCluster(confName, DbConf); err != nil {
+				return err
+			}
+		}
 	}
 	//手动配置连接
 	if dbpool, err := GetDBPool("default"); err == nil {
@@ -68,9 +65,41 @@ func InitDBPool(path string) error {
 	if dbpool, err := GetGormPool("default"); err == nil {
 		GORMDefaultPool = dbpool
 	}
+	startDBStatsLog()
 	return nil
 }
 
+//打开database/sql连接池，主库和从库使用相同的连接数设置
+func openDBPool(dsn string, DbConf *MYSQLConf) (*sql.DB, error) {
+	dbPool, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	//设置最 数
+	dbPool.SetMaxOpenConns(DbConf.MaxOpenConn)
+	dbPool.SetMaxIdleConns(DbConf.MaxIdleConn)
+	dbPool.SetConnMaxLifetime(time.Duration(DbConf.MaxConnLifeTime) * time.Second)
+	return dbPool, nil
+}
+
+//打开gorm连接池
+func openGormPool(name, dsn string, DbConf *MYSQLConf) (*gorm.DB, error) {
+	dbGorm, err := gorm.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	//默认使用单个表
+	dbGorm.SingularTable(true)
+	//当打印日志的时候获得上下文
+	dbGorm.LogCtx(true)
+	dbGorm.SetLogger(&MysqlGormLogger{Trace: NewTrace(), Pool: name})
+	dbGorm.DB().SetMaxIdleConns(DbConf.MaxIdleConn)
+	dbGorm.DB().SetMaxOpenConns(DbConf.MaxOpenConn)
+	dbGorm.DB().SetConnMaxLifetime(time.Duration(DbConf.MaxConnLifeTime) * time.Second)
+	return dbGorm, nil
+}
+
+//主库连接池
 func GetDBPool(name string) (*sql.DB, error) {
 	if dbpool, ok := DBMapPool[name]; ok {
 		return dbpool, nil
@@ -78,6 +107,7 @@ func GetDBPool(name string) (*sql.DB, error) {
 	return nil, errors.New("GetDBPool error")
 }
 
+//主库gorm连接池
 func GetGormPool(name string) (*gorm.DB, error) {
 	if dbpool, ok := GORMMapPool[name]; ok {
 		return dbpool, nil
@@ -86,6 +116,8 @@ func GetGormPool(name string) (*gorm.DB, error) {
 }
 
 func CloseDB() error {
+	stopDBStatsLog()
+	closeDBClusters()
 	for _, dbpool := range DBMapPool {
 		dbpool.Close()
 	}
@@ -100,19 +132,21 @@ func DBPoolLogQuery(trace *TraceContext, sqlDB *sql.DB, query string, args ...in
 	startExecTime := time.Now()
 	rows, err := sqlDB.Query(query, args...)
 	endExecTime := time.Now()
+	dbRecordQuery(trace, dbPoolName(sqlDB), query, args, endExecTime.Sub(startExecTime), err)
 	if err != nil {
 		//出错
-		Log.TagError(trace, "_com_mysql_success", map[string]interface{}{
+		Log.TagError(trace, DLTagMysqlFailed, map[string]interface{}{
 			"sql":       query,
 			"bind":      args,
-			"proc_time": fmt.Sprintf("%f", endExecTime.Sub(startExecTime).Seconds()),
+			"err":       err.Error(),
+			"proc_time": fmt.Sprintf("%fs", endExecTime.Sub(startExecTime).Seconds()),
 		})
 	} else {
 		//query成功
-		Log.TagInfo(trace, "_com_mysql_success", map[string]interface{}{
+		Log.TagInfo(trace, DLTagMysqlSuccess, map[string]interface{}{
 			"sql":       query,
 			"bind":      args,
-			"proc_time": fmt.Sprintf("%f", endExecTime.Sub(startExecTime).Seconds()),
+			"proc_time": fmt.Sprintf("%fs", endExecTime.Sub(startExecTime).Seconds()),
 		})
 	}
 	return rows, err
@@ -122,6 +156,7 @@ func DBPoolLogQuery(trace *TraceContext, sqlDB *sql.DB, query string, args ...in
 type MysqlGormLogger struct {
 	gorm.Logger
 	Trace *TraceContext
+	Pool  string //连接池名称，用于慢查询阈值和查询统计
 }
 
 func (logger *MysqlGormLogger) NowFunc() time.Time {
@@ -132,11 +167,9 @@ func (logger *MysqlGormLogger) NowFunc() time.Time {
 func (logger *MysqlGormLogger) LogFormatter(values ...interface{}) (messages map[string]interface{}) {
 	if len(values) > 1 {
 		var (
-			sql             string
-			formattedValues []string
-			level           = values[0]
-			currentTime     = logger.NowFunc().Format("2006-01-02 15:04:05")
-			source          = fmt.Sprintf("%v", values[1])
+			level       = values[0]
+			currentTime = logger.NowFunc().Format("2006-01-02 15:04:05")
+			source      = fmt.Sprintf("%v", values[1])
 		)
 		messages = map[string]interface{}{
 			"level":        level,
@@ -147,49 +180,7 @@ func (logger *MysqlGormLogger) LogFormatter(values ...interface{}) (messages map
 		if level == "sql" {
 			messages["proc_time"] = fmt.Sprintf("%fs", values[2].(time.Duration).Seconds())
 
-			for _, value := range values[4].([]interface{}) {
-				indirectValue := reflect.Indirect(reflect.ValueOf(value))
-				if indirectValue.IsValid() {
-					value = indirectValue.Interface()
-					//如果是时间
-					if t, ok := value.(time.Time); ok {
-						formattedValues = append(formattedValues, fmt.Sprintf("'%v'", t.Format("2006-01-02 15:04:05")))
-					} else if b, ok := value.([]byte); ok {
-						if str := string(b); logger.isPrintable(str) {
-							formattedValues = append(formattedValues, fmt.Sprintf("'%v'", str))
-						} else {
-							formattedValues = append(formattedValues, "'<binary>'")
-						}
-					} else if r, ok := value.(driver.Valuer); ok {
-						if value, err := r.Value(); err == nil && value != nil {
-							formattedValues = append(formattedValues, fmt.Sprintf("'%v'", value))
-						} else {
-							formattedValues = append(formattedValues, "NULL")
-						}
-					} else {
-						formattedValues = append(formattedValues, fmt.Sprintf("'%v'", value))
-					}
-				} else {
-					formattedValues = append(formattedValues, "NULL")
-				}
-
-			}
-			if regexp.MustCompile(`\$\d+`).MatchString(values[3].(string)) {
-				sql = values[3].(string)
-				for index, value := range formattedValues {
-					placeholder := fmt.Sprintf(`\$%d([^\d]|$)`, index+1)
-					sql = regexp.MustCompile(placeholder).ReplaceAllString(sql, value+"$1")
-				}
-			} else {
-				formattedValuesLength := len(formattedValues)
-				for index, value := range regexp.MustCompile(`\?`).Split(values[3].(string), -1) {
-					sql += value
-					if index < formattedValuesLength {
-						sql += formattedValues[index]
-					}
-				}
-			}
-			messages["sql"] = sql
+			messages["sql"] = interpolateSQL(values[3].(string), values[4].([]interface{}))
 			if len(values) > 5 {
 				messages["affected_row"] = strconv.FormatInt(values[5].(int64), 10)
 			}
@@ -201,7 +192,60 @@ func (logger *MysqlGormLogger) LogFormatter(values ...interface{}) (messages map
 	return
 }
 
-func (logger *MysqlGormLogger) isPrintable(s string) bool {
+//将参数代入sql，用于日志，支持?和$n占位符
+func interpolateSQL(query string, args []interface{}) string {
+	var (
+		sql             string
+		formattedValues []string
+	)
+	for _, value := range args {
+		indirectValue := reflect.Indirect(reflect.ValueOf(value))
+		if indirectValue.IsValid() {
+			value = indirectValue.Interface()
+			//如果是时间
+			if t, ok := value.(time.Time); ok {
+				formattedValues = append(formattedValues, fmt.Sprintf("'%v'", t.Format("2006-01-02 15:04:05")))
+			} else if b, ok := value.([]byte); ok {
+				if str := string(b); isPrintable(str) {
+					formattedValues = append(formattedValues, fmt.Sprintf("'%v'", str))
+				} else {
+					formattedValues = append(formattedValues, "'<binary>'")
+				}
+			} else if r, ok := value.(driver.Valuer); ok {
+				if value, err := r.Value(); err == nil && value != nil {
+					formattedValues = append(formattedValues, fmt.Sprintf("'%v'", value))
+				} else {
+					formattedValues = append(formattedValues, "NULL")
+				}
+			} else {
+				formattedValues = append(formattedValues, fmt.Sprintf("'%v'", value))
+			}
+		} else {
+			formattedValues = append(formattedValues, "NULL")
+		}
+
+	}
+	if sqlDollarRegexp.MatchString(query) {
+		sql = query
+		for index, value := range formattedValues {
+			placeholder := fmt.Sprintf(`\$%d([^\d]|$)`, index+1)
+			sql = regexp.MustCompile(placeholder).ReplaceAllString(sql, value+"$1")
+		}
+	} else {
+		formattedValuesLength := len(formattedValues)
+		for index, value := range strings.Split(query, "?") {
+			sql += value
+			if index < formattedValuesLength {
+				sql += formattedValues[index]
+			}
+		}
+	}
+	return sql
+}
+
+var sqlDollarRegexp = regexp.MustCompile(`\$\d+`)
+
+func isPrintable(s string) bool {
 	for _, r := range s {
 		if !unicode.IsPrint(r) {
 			return false
@@ -213,9 +257,11 @@ func (logger *MysqlGormLogger) isPrintable(s string) bool {
 func (logger *MysqlGormLogger) Print(values ...interface{}) {
 	message := logger.LogFormatter(values...)
 	if message["level"] == "sql" {
-		Log.TagInfo(logger.Trace, "_com_mysql_success", message)
+		Log.TagInfo(logger.Trace, DLTagMysqlSuccess, message)
+		//未开启LogCtx时拿不到执行语句的db，无法关联log级别报告的错误
+		logger.record(logger.Trace, values, nil)
 	} else {
-		Log.TagInfo(logger.Trace, "_com_mysql_failure", message)
+		Log.TagInfo(logger.Trace, DLTagMysqlFailed, message)
 	}
 }
 
@@ -228,9 +274,36 @@ func (logger *MysqlGormLogger) CtxPrint(s *gorm.DB, values ...interface{}) {
 	}
 	message := logger.LogFormatter(values...)
 	if message["level"] == "sql" {
-		Log.TagInfo(trace, "_com_mysql_success", message)
+		err := gormStatementError(s)
+		if err != nil {
+			message["err"] = err.Error()
+			Log.TagInfo(trace, DLTagMysqlFailed, message)
+		} else {
+			Log.TagInfo(trace, DLTagMysqlSuccess, message)
+		}
+		logger.record(trace, values, err)
 	} else {
-		Log.TagInfo(trace, "_com_mysql_failure", message)
+		Log.TagInfo(trace, DLTagMysqlFailed, message)
 	}
 
 }
+
+//gorm先以log级别单独打印语句的错误，再打印sql，打印sql时错误已保存在执行语句的db上
+//查询不到记录不算失败
+func gormStatementError(s *gorm.DB) error {
+	if s == nil || s.Error == nil || s.Error == gorm.ErrRecordNotFound {
+		return nil
+	}
+	return s.Error
+}
+
+//慢查询和查询统计
+func (logger *MysqlGormLogger) record(trace *TraceContext, values []interface{}, err error) {
+	if len(values) < 5 {
+		return
+	}
+	query, _ := values[3].(string)
+	cost, _ := values[2].(time.Duration)
+	args, _ := values[4].([]interface{})
+	dbRecordQuery(trace, logger.Pool, query, args, cost, err)
+}
@@ -0,0 +1,364 @@
+package tool
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+//*sql.DB、*sql.Tx、*sql.Conn的公共方法
+type dbQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+//查询单行，dest为结构体指针（按db标签对应列）或基础类型的指针
+//没有数据时返回sql.ErrNoRows，配置了从库时从从库读取，需要读主库时使用WithDBPrimary(ctx)
+func DBQueryRow(ctx context.Context, trace *TraceContext, name string, dest interface{}, query string, args ...interface{}) error {
+	db, err := dbReadPool(ctx, name)
+	if err != nil {
+		return err
+	}
+	return dbQueryRow(ctx, trace, name, db, dest, query, args...)
+}
+
+//查询多行，dest为结构体切片的指针（如*[]User、*[]*User）或基础类型切片的指针，从库规则与DBQueryRow相同
+func DBQuery(ctx context.Context, trace *TraceContext, name string, dest interface{}, query string, args ...interface{}) error {
+	db, err := dbReadPool(ctx, name)
+	if err != nil {
+		return err
+	}
+	return dbQuery(ctx, trace, name, db, dest, query, args...)
+}
+
+//执行insert、update、delete等，始终使用主库
+func DBExec(ctx context.Context, trace *TraceContext, name string, query string, args ...interface{}) (sql.Result, error) {
+	db, err := GetDBPool(name)
+	if err != nil {
+		return nil, err
+	}
+	return dbExec(ctx, trace, name, db, query, args...)
+}
+
+//使用命名参数查询多行，如 "select * from user where id=:id"，arg为map[string]interface{}或带db标签的结构体
+func DBNamedQuery(ctx context.Context, trace *TraceContext, name string, dest interface{}, query string, arg interface{}) error {
+	q, args, err := DBNamed(query, arg)
+	if err != nil {
+		return err
+	}
+	return DBQuery(ctx, trace, name, dest, q, args...)
+}
+
+//使用命名参数执行
+func DBNamedExec(ctx context.Context, trace *TraceContext, name string, query string, arg interface{}) (sql.Result, error) {
+	q, args, err := DBNamed(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return DBExec(ctx, trace, name, q, args...)
+}
+
+func dbQueryRow(ctx context.Context, trace *TraceContext, pool string, q dbQuerier, dest interface{}, query string, args ...interface{}) error {
+	startExecTime := time.Now()
+	count, err := dbScanRows(ctx, q, dest, false, query, args...)
+	dbLog(trace, pool, query, args, startExecTime, err, map[string]interface{}{"rows": count})
+	if err == nil && count == 0 {
+		//没有数据不属于执行失败
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+func dbQuery(ctx context.Context, trace *TraceContext, pool string, q dbQuerier, dest interface{}, query string, args ...interface{}) error {
+	startExecTime := time.Now()
+	count, err := dbScanRows(ctx, q, dest, true, query, args...)
+	dbLog(trace, pool, query, args, startExecTime, err, map[string]interface{}{"rows": count})
+	return err
+}
+
+func dbExec(ctx context.Context, trace *TraceContext, pool string, q dbQuerier, query string, args ...interface{}) (sql.Result, error) {
+	startExecTime := time.Now()
+	res, err := q.ExecContext(ctx, query, args...)
+	fields := map[string]interface{}{}
+	if err == nil {
+		if affected, err := res.RowsAffected(); err == nil {
+			fields["affected_row"] = affected
+		}
+		if lastId, err := res.LastInsertId(); err == nil && lastId > 0 {
+			fields["last_insert_id"] = lastId
+		}
+	}
+	dbLog(trace, pool, query, args, startExecTime, err, fields)
+	return res, err
+}
+
+//记录sql日志，成功和失败使用不同的dltag，并记录慢查询和查询统计
+func dbLog(trace *TraceContext, pool string, query string, args []interface{}, startExecTime time.Time, err error, fields map[string]interface{}) {
+	if trace == nil {
+		trace = NewTrace()
+	}
+	endExecTime := time.Now()
+	dbRecordQuery(trace, pool, query, args, endExecTime.Sub(startExecTime), err)
+	m := map[string]interface{}{
+		"sql":       query,
+		"bind":      args,
+		"proc_time": fmt.Sprintf("%fs", endExecTime.Sub(startExecTime).Seconds()),
+	}
+	for k, v := range fields {
+		m[k] = v
+	}
+	if err != nil {
+		m["err"] = err.Error()
+		Log.TagError(trace, DLTagMysqlFailed, m)
+		return
+	}
+	Log.TagInfo(trace, DLTagMysqlSuccess, m)
+}
+
+//执行查询并扫描到dest，many为false时只读取第一行，返回读取的行数
+func dbScanRows(ctx context.Context, q dbQuerier, dest interface{}, many bool, query string, args ...interface{}) (int, error) {
+	rv := reflect.ValueOf(dest)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return 0, fmt.Errorf("db scan: dest must be a non-nil pointer, got %T", dest)
+	}
+	target := rv.Elem()
+	elemType := target.Type()
+	if many {
+		if target.Kind() != reflect.Slice {
+			return 0, fmt.Errorf("db scan: dest must be a pointer to slice, got %T", dest)
+		}
+		elemType = elemType.Elem()
+	}
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	isPtr := elemType.Kind() == reflect.Ptr
+	baseType := elemType
+	if isPtr {
+		baseType = elemType.Elem()
+	}
+	var fields [][]int
+	if dbIsStruct(baseType) {
+		if fields, err = dbColumnFields(baseType, columns); err != nil {
+			return 0, err
+		}
+	} else if len(columns) != 1 {
+		return 0, fmt.Errorf("db scan: scanning into %s needs exactly 1 column, got %d", baseType, len(columns))
+	}
+
+	count := 0
+	if many {
+		//无数据时返回空切片而不是nil
+		target.Set(reflect.MakeSlice(target.Type(), 0, 0))
+	}
+	for rows.Next() {
+		elem := reflect.New(baseType)
+		scanArgs := []interface{}{elem.Interface()}
+		if fields != nil {
+			scanArgs = make([]interface{}, len(fields))
+			for i, index := range fields {
+				scanArgs[i] = dbFieldByIndex(elem.Elem(), index).Addr().Interface()
+			}
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			return count, err
+		}
+		count++
+		if !isPtr {
+			elem = elem.Elem()
+		}
+		if !many {
+			target.Set(elem)
+			break
+		}
+		target.Set(reflect.Append(target, elem))
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+//结构体按字段扫描，实现了sql.Scanner的类型和time.Time按单列扫描
+func dbIsStruct(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct || t == reflect.TypeOf(time.Time{}) {
+		return false
+	}
+	return !reflect.PtrTo(t).Implements(reflect.TypeOf((*sql.Scanner)(nil)).Elem())
+}
+
+//结构体类型 -> db列名 -> 字段索引
+var dbFieldCache sync.Map
+
+//结构体的db列名与字段索引，使用db标签，没有标签时为小写的字段名，db:"-"忽略，匿名结构体字段展开
+func dbFieldMap(t reflect.Type) map[string][]int {
+	if m, ok := dbFieldCache.Load(t); ok {
+		return m.(map[string][]int)
+	}
+	m := map[string][]int{}
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := strings.Split(field.Tag.Get("db"), ",")[0]
+			if tag == "-" {
+				continue
+			}
+			fieldIndex := append(append([]int{}, index...), i)
+			if field.Anonymous && tag == "" {
+				ft := field.Type
+				if ft.Kind() == reflect.Ptr {
+					//未导出类型的匿名指针为nil时无法初始化，跳过其中的字段
+					if field.PkgPath != "" {
+						continue
+					}
+					ft = ft.Elem()
+				}
+				if dbIsStruct(ft) {
+					walk(ft, fieldIndex)
+					continue
+				}
+			}
+			if field.PkgPath != "" {
+				continue
+			}
+			if tag == "" {
+				tag = strings.ToLower(field.Name)
+			}
+			//外层字段优先
+			if exist, ok := m[tag]; !ok || len(fieldIndex) < len(exist) {
+				m[tag] = fieldIndex
+			}
+		}
+	}
+	walk(t, nil)
+	dbFieldCache.Store(t, m)
+	return m
+}
+
+func dbColumnFields(t reflect.Type, columns []string) ([][]int, error) {
+	fieldMap := dbFieldMap(t)
+	fields := make([][]int, len(columns))
+	for i, column := range columns {
+		index, ok := fieldMap[strings.ToLower(column)]
+		if !ok {
+			return nil, fmt.Errorf("db scan: column %s has no matching field in %s", column, t)
+		}
+		fields[i] = index
+	}
+	return fields, nil
+}
+
+//按索引获取字段，匿名结构体指针为nil时初始化
+func dbFieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+//将命名参数 :name 转换为 ? 占位符，arg为map[string]interface{}或带db标签的结构体（指针）
+//引号中的内容不会被替换，"::"表示字面的":"
+func DBNamed(query string, arg interface{}) (string, []interface{}, error) {
+	lookup, err := dbNamedLookup(arg)
+	if err != nil {
+		return "", nil, err
+	}
+	buf := strings.Builder{}
+	args := []interface{}{}
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if quote != 0 {
+			buf.WriteByte(c)
+			if c == '\\' && quote != '`' && i+1 < len(query) {
+				i++
+				buf.WriteByte(query[i])
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			buf.WriteByte(c)
+		case c == ':' && i+1 < len(query) && query[i+1] == ':':
+			buf.WriteByte(':')
+			i++
+		case c == ':' && i+1 < len(query) && dbIsNameChar(query[i+1]):
+			j := i + 1
+			for j < len(query) && dbIsNameChar(query[j]) {
+				j++
+			}
+			name := query[i+1 : j]
+			val, ok := lookup(name)
+			if !ok {
+				return "", nil, fmt.Errorf("db named: parameter %s not found in %T", name, arg)
+			}
+			args = append(args, val)
+			buf.WriteByte('?')
+			i = j - 1
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	if quote != 0 {
+		return "", nil, errors.New("db named: unterminated quote in query")
+	}
+	return buf.String(), args, nil
+}
+
+func dbIsNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func dbNamedLookup(arg interface{}) (func(name string) (interface{}, bool), error) {
+	if m, ok := arg.(map[string]interface{}); ok {
+		return func(name string) (interface{}, bool) {
+			v, ok := m[name]
+			return v, ok
+		}, nil
+	}
+	rv := reflect.Indirect(reflect.ValueOf(arg))
+	if !rv.IsValid() || rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("db named: arg must be map[string]interface{} or struct, got %T", arg)
+	}
+	fieldMap := dbFieldMap(rv.Type())
+	return func(name string) (interface{}, bool) {
+		index, ok := fieldMap[strings.ToLower(name)]
+		if !ok {
+			return nil, false
+		}
+		v := rv
+		for i, x := range index {
+			if i > 0 && v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					return nil, true
+				}
+				v = v.Elem()
+			}
+			v = v.Field(x)
+		}
+		return v.Interface(), true
+	}, nil
+}
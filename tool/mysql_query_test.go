@@ -0,0 +1,245 @@
+package tool
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//测试用的database/sql驱动，按sql返回结果
+type fakeDBResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+	err      error
+}
+
+type fakeDBDriver struct {
+	mu      sync.Mutex
+	handler func(query string, args []driver.Value) fakeDBResult
+	queries []string
+}
+
+func (d *fakeDBDriver) Open(name string) (driver.Conn, error) {
+	return &fakeDBConn{d: d}, nil
+}
+
+func (d *fakeDBDriver) do(query string, args []driver.Value) fakeDBResult {
+	d.mu.Lock()
+	d.queries = append(d.queries, query)
+	d.mu.Unlock()
+	return d.handler(query, args)
+}
+
+type fakeDBConn struct {
+	d *fakeDBDriver
+}
+
+func (c *fakeDBConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeDBStmt{c: c, query: query}, nil
+}
+
+func (c *fakeDBConn) Close() error { return nil }
+
+func (c *fakeDBConn) Begin() (driver.Tx, error) {
+	if res := c.d.do("BEGIN", nil); res.err != nil {
+		return nil, res.err
+	}
+	return &fakeDBTx{c: c}, nil
+}
+
+type fakeDBTx struct {
+	c *fakeDBConn
+}
+
+func (t *fakeDBTx) Commit() error   { return t.c.d.do("COMMIT", nil).err }
+func (t *fakeDBTx) Rollback() error { return t.c.d.do("ROLLBACK", nil).err }
+
+type fakeDBStmt struct {
+	c     *fakeDBConn
+	query string
+}
+
+func (s *fakeDBStmt) Close() error  { return nil }
+func (s *fakeDBStmt) NumInput() int { return -1 }
+
+func (s *fakeDBStmt) Exec(args []driver.Value) (driver.Result, error) {
+	res := s.c.d.do(s.query, args)
+	if res.err != nil {
+		return nil, res.err
+	}
+	return driver.RowsAffected(res.affected), nil
+}
+
+func (s *fakeDBStmt) Query(args []driver.Value) (driver.Rows, error) {
+	res := s.c.d.do(s.query, args)
+	if res.err != nil {
+		return nil, res.err
+	}
+	return &fakeDBRows{columns: res.columns, rows: res.rows}, nil
+}
+
+type fakeDBRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeDBRows) Columns() []string { return r.columns }
+func (r *fakeDBRows) Close() error      { return nil }
+
+func (r *fakeDBRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var fakeDBSeq int
+var fakeDBSeqMu sync.Mutex
+
+//注册名为name的测试连接池
+func newFakeDBPool(t *testing.T, name string, handler func(query string, args []driver.Value) fakeDBResult) *fakeDBDriver {
+	fakeDBSeqMu.Lock()
+	fakeDBSeq++
+	driverName := fmt.Sprintf("tool_fakedb_%d", fakeDBSeq)
+	fakeDBSeqMu.Unlock()
+	d := &fakeDBDriver{handler: handler}
+	sql.Register(driverName, d)
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if DBMapPool == nil {
+		DBMapPool = map[string]*sql.DB{}
+	}
+	DBMapPool[name] = db
+	return d
+}
+
+type dbTestBase struct {
+	Id int64 `db:"id"`
+}
+
+type dbTestUser struct {
+	dbTestBase
+	Name      string         `db:"name"`
+	Email     sql.NullString `db:"email"`
+	CreatedAt time.Time      `db:"created_at"`
+	Ignored   string         `db:"-"`
+}
+
+func TestDBQuery(t *testing.T) {
+	now := time.Now()
+	newFakeDBPool(t, "query_test", func(query string, args []driver.Value) fakeDBResult {
+		switch {
+		case strings.HasPrefix(query, "select id, name, email, created_at"):
+			return fakeDBResult{
+				columns: []string{"id", "name", "email", "created_at"},
+				rows: [][]driver.Value{
+					{int64(1), "a", nil, now},
+					{int64(2), "b", "b@example.com", now},
+				},
+			}
+		case strings.HasPrefix(query, "select count(*)"):
+			return fakeDBResult{columns: []string{"count(*)"}, rows: [][]driver.Value{{int64(2)}}}
+		case strings.HasPrefix(query, "select name from user where id=?"):
+			if args[0] != int64(3) {
+				return fakeDBResult{err: errors.New("unexpected args")}
+			}
+			return fakeDBResult{columns: []string{"name"}}
+		case strings.HasPrefix(query, "update"):
+			return fakeDBResult{affected: 2}
+		}
+		return fakeDBResult{err: errors.New("unknown query " + query)}
+	})
+	defer delete(DBMapPool, "query_test")
+	ctx := context.Background()
+
+	users := []*dbTestUser{}
+	if err := DBQuery(ctx, NewTrace(), "query_test", &users, "select id, name, email, created_at from user"); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Id != 1 || users[1].Name != "b" || users[0].Email.Valid || users[1].Email.String != "b@example.com" {
+		t.Fatalf("unexpected users %+v %+v", users[0], users[1])
+	}
+
+	user := dbTestUser{}
+	if err := DBQueryRow(ctx, NewTrace(), "query_test", &user, "select id, name, email, created_at from user limit 1"); err != nil || user.Id != 1 {
+		t.Fatalf("unexpected user %+v %v", user, err)
+	}
+	var count int
+	if err := DBQueryRow(ctx, NewTrace(), "query_test", &count, "select count(*) from user"); err != nil || count != 2 {
+		t.Fatalf("unexpected count %d %v", count, err)
+	}
+	var name string
+	err := DBNamedQuery(ctx, NewTrace(), "query_test", &[]string{}, "select name from user where id=:id", map[string]interface{}{"id": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DBQueryRow(ctx, NewTrace(), "query_test", &name, "select name from user where id=?", 3); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+
+	res, err := DBNamedExec(ctx, NewTrace(), "query_test", "update user set name=:name where id=:id", &dbTestUser{dbTestBase: dbTestBase{Id: 1}, Name: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected, _ := res.RowsAffected(); affected != 2 {
+		t.Fatalf("unexpected affected rows %d", affected)
+	}
+	if _, err := DBExec(ctx, NewTrace(), "query_test", "delete from user"); err == nil {
+		t.Fatal("expected exec error")
+	}
+	if err := DBQuery(ctx, NewTrace(), "missing_pool", &users, "select 1"); err == nil {
+		t.Fatal("expected missing pool error")
+	}
+}
+
+func TestDBNamed(t *testing.T) {
+	query, args, err := DBNamed("select * from user where name=:name and note=':skip' and t::date and id in (:id, :id)", map[string]interface{}{"name": "a", "id": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "select * from user where name=? and note=':skip' and t:date and id in (?, ?)" || len(args) != 3 || args[0] != "a" {
+		t.Fatalf("unexpected named result %s %v", query, args)
+	}
+	if _, _, err := DBNamed("select :missing", map[string]interface{}{}); err == nil {
+		t.Fatal("expected missing parameter error")
+	}
+	//参数名只包含字母、数字和下划线
+	query, args, err = DBNamed("select * from t1 where t1.a=:a.b", map[string]interface{}{"a": 1})
+	if err != nil || query != "select * from t1 where t1.a=?.b" || len(args) != 1 {
+		t.Fatalf("unexpected named result %s %v %v", query, args, err)
+	}
+}
+
+//未导出类型的匿名指针无法初始化，其中的字段不参与映射
+func TestDBScanUnexportedEmbeddedPtr(t *testing.T) {
+	type user struct {
+		*dbTestBase
+		Name string `db:"name"`
+	}
+	newFakeDBPool(t, "embedded_ptr_test", func(query string, args []driver.Value) fakeDBResult {
+		if strings.HasPrefix(query, "select id") {
+			return fakeDBResult{columns: []string{"id", "name"}, rows: [][]driver.Value{{int64(1), "a"}}}
+		}
+		return fakeDBResult{columns: []string{"name"}, rows: [][]driver.Value{{"a"}}}
+	})
+	ctx := context.Background()
+	users := []user{}
+	if err := DBQuery(ctx, NewTrace(), "embedded_ptr_test", &users, "select id, name from user"); err == nil {
+		t.Fatal("expected no matching field error")
+	}
+	if err := DBQuery(ctx, NewTrace(), "embedded_ptr_test", &users, "select name from user"); err != nil || len(users) != 1 || users[0].Name != "a" {
+		t.Fatalf("unexpected result %+v %v", users, err)
+	}
+}
@@ -0,0 +1,321 @@
+package tool
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e421083458/gorm"
+)
+
+const (
+	replicaCheckIntervalDefault = 5 * time.Second
+	replicaCheckTimeout         = 2 * time.Second
+)
+
+//从库
+type dbReplica struct {
+	name    string //连接池名#序号，用于日志
+	dsn     string //已隐藏密码，用于日志
+	weight  int
+	db      *sql.DB
+	gorm    *gorm.DB
+	healthy int32 //1为健康，0为已摘除，-1为还未检查
+	lag     int64 //最近一次检测到的延迟（秒），-1为未知
+}
+
+func (r *dbReplica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+//一个主库对应的全部从库
+type dbCluster struct {
+	name     string
+	replicas []*dbReplica
+	maxLag   int
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+var (
+	dbClusterMu  sync.RWMutex
+	dbClusterMap = map[string]*dbCluster{}
+)
+
+type dbPrimaryKey struct{}
+
+//强制使用主库读取，如写入后需要立即读到最新数据时
+func WithDBPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dbPrimaryKey{}, true)
+}
+
+//读请求使用的连接池：按权重选择一个健康的从库，没有配置从库或从库均不可用时使用主库
+func GetDBReadPool(name string) (*sql.DB, error) {
+	if r := pickDBReplica(name); r != nil && r.db != nil {
+		return r.db, nil
+	}
+	return GetDBPool(name)
+}
+
+//读请求使用的gorm连接池，规则与GetDBReadPool相同
+func GetGormReadPool(name string) (*gorm.DB, error) {
+	if r := pickDBReplica(name); r != nil && r.gorm != nil {
+		return r.gorm, nil
+	}
+	return GetGormPool(name)
+}
+
+//写请求和事务使用的连接池，即主库
+func GetDBWritePool(name string) (*sql.DB, error) {
+	return GetDBPool(name)
+}
+
+func GetGormWritePool(name string) (*gorm.DB, error) {
+	return GetGormPool(name)
+}
+
+//按ctx选择连接池，WithDBPrimary时使用主库
+func dbReadPool(ctx context.Context, name string) (*sql.DB, error) {
+	if primary, _ := ctx.Value(dbPrimaryKey{}).(bool); primary {
+		return GetDBPool(name)
+	}
+	return GetDBReadPool(name)
+}
+
+func pickDBReplica(name string) *dbReplica {
+	dbClusterMu.RLock()
+	c := dbClusterMap[name]
+	dbClusterMu.RUnlock()
+	if c == nil {
+		return nil
+	}
+	return c.pick()
+}
+
+//打开从库连接池并开始健康检查，从库连接失败不影响初始化，只是暂时摘除
+func openDBCluster(name string, DbConf *MYSQLConf) error {
+	replicas := make([]*dbReplica, 0, len(DbConf.Replicas))
+	for i, replicaConf := range DbConf.Replicas {
+		if replicaConf == nil || replicaConf.DataSourceName == "" {
+			return fmt.Errorf("mysql %s: replicas[%d].data_source_name is required", name, i)
+		}
+		dbPool, err := openDBPool(replicaConf.DataSourceName, DbConf)
+		if err != nil {
+			return err
+		}
+		dbGorm, err := openGormPool(name, replicaConf.DataSourceName, DbConf)
+		if err != nil {
+			dbPool.Close()
+			return err
+		}
+		replicas = append(replicas, &dbReplica{
+			name:   fmt.Sprintf("%s#%d", name, i),
+			dsn:    RedactDSN(replicaConf.DataSourceName),
+			weight: replicaConf.Weight,
+			db:     dbPool,
+			gorm:   dbGorm,
+		})
+	}
+	interval := time.Duration(DbConf.ReplicaCheckInterval) * time.Second
+	startDBCluster(newDBCluster(name, replicas, DbConf.MaxReplicaLag, interval))
+	return nil
+}
+
+func newDBCluster(name string, replicas []*dbReplica, maxLag int, interval time.Duration) *dbCluster {
+	if interval <= 0 {
+		interval = replicaCheckIntervalDefault
+	}
+	for _, r := range replicas {
+		if r.weight <= 0 {
+			r.weight = 1
+		}
+		r.healthy = -1
+		r.lag = -1
+	}
+	return &dbCluster{
+		name:     name,
+		replicas: replicas,
+		maxLag:   maxLag,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+//先同步检查一次，保证初始化完成后即可按健康状态路由
+func startDBCluster(c *dbCluster) {
+	c.check()
+	go c.loop()
+	dbClusterMu.Lock()
+	old := dbClusterMap[c.name]
+	dbClusterMap[c.name] = c
+	dbClusterMu.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+func closeDBClusters() {
+	dbClusterMu.Lock()
+	clusters := dbClusterMap
+	dbClusterMap = map[string]*dbCluster{}
+	dbClusterMu.Unlock()
+	for _, c := range clusters {
+		c.close()
+	}
+}
+
+//按权重随机选择健康的从库，没有时返回nil
+func (c *dbCluster) pick() *dbReplica {
+	total := 0
+	for _, r := range c.replicas {
+		if r.isHealthy() {
+			total += r.weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for _, r := range c.replicas {
+		if !r.isHealthy() {
+			continue
+		}
+		if n < r.weight {
+			return r
+		}
+		n -= r.weight
+	}
+	return nil
+}
+
+func (c *dbCluster) loop() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.check()
+		}
+	}
+}
+
+func (c *dbCluster) close() {
+	close(c.stop)
+	<-c.done
+	for _, r := range c.replicas {
+		if r.db != nil {
+			r.db.Close()
+		}
+		if r.gorm != nil {
+			r.gorm.Close()
+		}
+	}
+}
+
+//检查全部从库，状态变化时记录日志，第一次检查的结果也会记录
+func (c *dbCluster) check() {
+	for _, r := range c.replicas {
+		startExecTime := time.Now()
+		lag, err := c.checkReplica(r)
+		atomic.StoreInt64(&r.lag, lag)
+		var healthy int32 = 1
+		if err != nil {
+			healthy = 0
+		}
+		if atomic.SwapInt32(&r.healthy, healthy) == healthy {
+			continue
+		}
+		endExecTime := time.Now()
+		m := map[string]interface{}{
+			"replica":   r.name,
+			"dsn":       r.dsn,
+			"lag":       lag,
+			"proc_time": fmt.Sprintf("%fs", endExecTime.Sub(startExecTime).Seconds()),
+		}
+		if err != nil {
+			m["msg"] = "replica ejected"
+			m["err"] = err.Error()
+			Log.TagWarn(NewTrace(), DLTagMysqlFailed, m)
+		} else {
+			m["msg"] = "replica healthy"
+			Log.TagInfo(NewTrace(), DLTagMysqlSuccess, m)
+		}
+	}
+}
+
+//探测从库是否可用，配置了max_replica_lag时检查复制延迟，返回延迟秒数
+func (c *dbCluster) checkReplica(r *dbReplica) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+	defer cancel()
+	if err := r.db.PingContext(ctx); err != nil {
+		return -1, err
+	}
+	if c.maxLag <= 0 {
+		return -1, nil
+	}
+	lag, err := replicaLag(ctx, r.db)
+	if err != nil {
+		return lag, err
+	}
+	if lag > int64(c.maxLag) {
+		return lag, fmt.Errorf("replica lag %ds exceeds max_replica_lag %ds", lag, c.maxLag)
+	}
+	return lag, nil
+}
+
+//通过SHOW REPLICA STATUS获取复制延迟，延迟为NULL表示复制已停止
+//MySQL 8.0.22之前不支持SHOW REPLICA STATUS，失败时使用SHOW SLAVE STATUS（8.4已移除）
+func replicaLag(ctx context.Context, db *sql.DB) (int64, error) {
+	rows, err := db.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil && ctx.Err() == nil {
+		rows, err = db.QueryContext(ctx, "SHOW SLAVE STATUS")
+	}
+	if err != nil {
+		return -1, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return -1, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return -1, err
+		}
+		return -1, errors.New("replica status is empty, not a replica")
+	}
+	values := make([]sql.RawBytes, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	if err := rows.Scan(scanArgs...); err != nil {
+		return -1, err
+	}
+	for i, column := range columns {
+		//MySQL 8.0.22之后为Seconds_Behind_Source
+		if column != "Seconds_Behind_Master" && column != "Seconds_Behind_Source" {
+			continue
+		}
+		if values[i] == nil {
+			return -1, errors.New("replication is not running")
+		}
+		lag, err := strconv.ParseInt(string(values[i]), 10, 64)
+		if err != nil {
+			return -1, err
+		}
+		return lag, nil
+	}
+	return -1, errors.New("replica status has no Seconds_Behind_Master column")
+}
@@ -0,0 +1,152 @@
+package tool
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//从库延迟为lag秒，lag<0时返回错误，模拟不支持SHOW REPLICA STATUS的旧版本
+func newFakeReplica(t *testing.T, name string, lag *int64) (*dbReplica, *fakeDBDriver) {
+	d := newFakeDBPool(t, name, func(query string, args []driver.Value) fakeDBResult {
+		if query == "SHOW REPLICA STATUS" {
+			return fakeDBResult{err: errors.New("Error 1064: You have an error in your SQL syntax")}
+		}
+		if query == "SHOW SLAVE STATUS" {
+			l := atomic.LoadInt64(lag)
+			if l < 0 {
+				return fakeDBResult{err: errors.New("connection refused")}
+			}
+			return fakeDBResult{
+				columns: []string{"Slave_IO_State", "Seconds_Behind_Master"},
+				rows:    [][]driver.Value{{"Waiting for master to send event", l}},
+			}
+		}
+		return fakeDBResult{columns: []string{"v"}, rows: [][]driver.Value{{name}}}
+	})
+	r := &dbReplica{name: name, db: DBMapPool[name]}
+	delete(DBMapPool, name)
+	return r, d
+}
+
+func TestDBReplicaRouting(t *testing.T) {
+	primary := newFakeDBPool(t, "replica_test", func(query string, args []driver.Value) fakeDBResult {
+		if query == "update user set name=?" {
+			return fakeDBResult{affected: 1}
+		}
+		return fakeDBResult{columns: []string{"v"}, rows: [][]driver.Value{{"primary"}}}
+	})
+	lag1, lag2 := int64(1), int64(100)
+	r1, d1 := newFakeReplica(t, "replica_test#0", &lag1)
+	r2, _ := newFakeReplica(t, "replica_test#1", &lag2)
+	c := newDBCluster("replica_test", []*dbReplica{r1, r2}, 10, time.Hour)
+	startDBCluster(c)
+	defer func() {
+		dbClusterMu.Lock()
+		delete(dbClusterMap, "replica_test")
+		dbClusterMu.Unlock()
+		c.close()
+	}()
+
+	ctx := context.Background()
+	var v string
+	for i := 0; i < 10; i++ {
+		if err := DBQueryRow(ctx, nil, "replica_test", &v, "select v"); err != nil {
+			t.Fatal(err)
+		}
+		//r2延迟超过max_replica_lag被摘除
+		if v != "replica_test#0" {
+			t.Fatalf("read routed to %s, want replica_test#0", v)
+		}
+	}
+	if err := DBQueryRow(WithDBPrimary(ctx), nil, "replica_test", &v, "select v"); err != nil || v != "primary" {
+		t.Fatalf("WithDBPrimary read from %s, err %v", v, err)
+	}
+	if _, err := DBExec(ctx, nil, "replica_test", "update user set name=?", "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range d1.queries {
+		if q == "update user set name=?" {
+			t.Fatal("write routed to replica")
+		}
+	}
+	if len(primary.queries) != 2 {
+		t.Fatalf("primary queries %v", primary.queries)
+	}
+
+	//从库均不可用时读主库
+	atomic.StoreInt64(&lag1, -1)
+	c.check()
+	if err := DBQueryRow(ctx, nil, "replica_test", &v, "select v"); err != nil || v != "primary" {
+		t.Fatalf("fallback read from %s, err %v", v, err)
+	}
+
+	//恢复后重新加入
+	atomic.StoreInt64(&lag1, 0)
+	atomic.StoreInt64(&lag2, 3)
+	c.check()
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		if err := DBQueryRow(ctx, nil, "replica_test", &v, "select v"); err != nil {
+			t.Fatal(err)
+		}
+		seen[v] = true
+	}
+	if !seen["replica_test#0"] || !seen["replica_test#1"] || seen["primary"] {
+		t.Fatalf("reads after recovery %v", seen)
+	}
+}
+
+func TestDBClusterPickWeight(t *testing.T) {
+	replicas := []*dbReplica{{name: "a", weight: 3, healthy: 1}, {name: "b", weight: 1, healthy: 1}, {name: "c", weight: 5}}
+	c := &dbCluster{replicas: replicas}
+	count := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		count[c.pick().name]++
+	}
+	if count["c"] != 0 {
+		t.Fatalf("unhealthy replica picked %d times", count["c"])
+	}
+	if count["a"] < 2700 || count["a"] > 3300 {
+		t.Fatalf("weighted pick %v", count)
+	}
+}
+
+func TestReplicaLag(t *testing.T) {
+	d := newFakeDBPool(t, "replica_lag_test", func(query string, args []driver.Value) fakeDBResult {
+		if query == "SHOW REPLICA STATUS" {
+			return fakeDBResult{
+				columns: []string{"Replica_IO_State", "Seconds_Behind_Source"},
+				rows:    [][]driver.Value{{"Waiting for source to send event", int64(7)}},
+			}
+		}
+		return fakeDBResult{err: errors.New("Error 1064: You have an error in your SQL syntax")}
+	})
+	db := DBMapPool["replica_lag_test"]
+	delete(DBMapPool, "replica_lag_test")
+	lag, err := replicaLag(context.Background(), db)
+	if err != nil || lag != 7 {
+		t.Fatalf("lag %d, err %v", lag, err)
+	}
+	for _, q := range d.queries {
+		if q == "SHOW SLAVE STATUS" {
+			t.Fatal("SHOW SLAVE STATUS should not be used when SHOW REPLICA STATUS works")
+		}
+	}
+
+	//第一次检查即不可用的从库被摘除
+	lag1 := int64(-1)
+	r, _ := newFakeReplica(t, "replica_lag_test#0", &lag1)
+	c := newDBCluster("replica_lag_test", []*dbReplica{r}, 10, time.Hour)
+	if atomic.LoadInt32(&r.healthy) != -1 {
+		t.Fatal("replica state should be unknown before the first check")
+	}
+	c.check()
+	if r.isHealthy() || atomic.LoadInt32(&r.healthy) != 0 {
+		t.Fatalf("replica should be ejected, state %d", r.healthy)
+	}
+	r.db.Close()
+}
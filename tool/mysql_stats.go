@@ -0,0 +1,329 @@
+package tool
+
+import (
+	"database/sql"
+	"fmt"
+	"lib/tool/metrics"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DLTagMysqlSlow  = "_com_mysql_slow"  //MySQL慢查询
+	DLTagMysqlStats = "_com_mysql_stats" //MySQL查询统计
+)
+
+const (
+	dbStatSamples    = 1024    //每条语句保留最近的耗时样本数，用于计算分位数
+	dbStatMaxQueries = 1000    //最多统计的语句数，超过后计入dbStatOther
+	dbStatOther      = "OTHER" //超过统计上限的语句
+)
+
+//定期打印查询统计的间隔，0为不打印，需要在InitDBPool之前设置
+var DBQueryStatsInterval = time.Minute
+
+//按连接池和归一化后的语句统计的查询信息
+type DBQueryStat struct {
+	Pool       string        `json:"pool"`
+	Query      string        `json:"query"`
+	Count      int64         `json:"count"`
+	ErrorCount int64         `json:"error_count"`
+	P50        time.Duration `json:"p50"`
+	P95        time.Duration `json:"p95"`
+	P99        time.Duration `json:"p99"`
+	Max        time.Duration `json:"max"`
+}
+
+type dbStatKey struct {
+	pool  string
+	query string
+}
+
+type dbStatEntry struct {
+	count   int64
+	errors  int64
+	max     time.Duration
+	samples []time.Duration //环形缓冲
+	next    int
+	logged  int64 //上次打印时的count
+}
+
+var (
+	dbStatMu  sync.Mutex
+	dbStatMap = map[dbStatKey]*dbStatEntry{}
+
+	dbSlowMu         sync.RWMutex
+	dbSlowThresholds = map[string]time.Duration{}
+
+	dbStatLogMu   sync.Mutex
+	dbStatLogStop chan struct{}
+	dbStatLogDone chan struct{}
+)
+
+//设置连接池的慢查询阈值，0为不记录慢查询
+func SetDBSlowThreshold(pool string, threshold time.Duration) {
+	dbSlowMu.Lock()
+	defer dbSlowMu.Unlock()
+	if threshold <= 0 {
+		delete(dbSlowThresholds, pool)
+		return
+	}
+	dbSlowThresholds[pool] = threshold
+}
+
+func dbSlowThreshold(pool string) time.Duration {
+	dbSlowMu.RLock()
+	defer dbSlowMu.RUnlock()
+	return dbSlowThresholds[pool]
+}
+
+//记录一次查询：超过慢查询阈值时打印WARN日志，并计入查询统计和监控指标
+func dbRecordQuery(trace *TraceContext, pool, query string, args []interface{}, cost time.Duration, err error) {
+	if threshold := dbSlowThreshold(pool); threshold > 0 && cost >= threshold {
+		if trace == nil {
+			trace = NewTrace()
+		}
+		m := map[string]interface{}{
+			"pool":      pool,
+			"sql":       interpolateSQL(query, args),
+			"threshold": threshold.String(),
+			"proc_time": fmt.Sprintf("%fs", cost.Seconds()),
+		}
+		if err != nil {
+			m["err"] = err.Error()
+		}
+		Log.TagWarn(trace, DLTagMysqlSlow, m)
+	}
+
+	metrics.ObserveMySQLQuery(pool, err, cost)
+
+	key := dbStatKey{pool: pool, query: NormalizeSQL(query)}
+	dbStatMu.Lock()
+	defer dbStatMu.Unlock()
+	entry, ok := dbStatMap[key]
+	if !ok {
+		if len(dbStatMap) >= dbStatMaxQueries {
+			key.query = dbStatOther
+			entry = dbStatMap[key]
+		}
+		if entry == nil {
+			entry = &dbStatEntry{}
+			dbStatMap[key] = entry
+		}
+	}
+	entry.count++
+	if err != nil {
+		entry.errors++
+	}
+	if cost > entry.max {
+		entry.max = cost
+	}
+	if len(entry.samples) < dbStatSamples {
+		entry.samples = append(entry.samples, cost)
+	} else {
+		entry.samples[entry.next] = cost
+		entry.next = (entry.next + 1) % dbStatSamples
+	}
+}
+
+//返回查询统计，按连接池、查询次数倒序排列，分位数按每条语句最近的1024次查询计算
+func GetDBQueryStats() []DBQueryStat {
+	dbStatMu.Lock()
+	defer dbStatMu.Unlock()
+	stats := make([]DBQueryStat, 0, len(dbStatMap))
+	for key, entry := range dbStatMap {
+		stats = append(stats, entry.stat(key))
+	}
+	sortDBQueryStats(stats)
+	return stats
+}
+
+//清空查询统计
+func ResetDBQueryStats() {
+	dbStatMu.Lock()
+	defer dbStatMu.Unlock()
+	dbStatMap = map[dbStatKey]*dbStatEntry{}
+}
+
+func (e *dbStatEntry) stat(key dbStatKey) DBQueryStat {
+	samples := append([]time.Duration{}, e.samples...)
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return DBQueryStat{
+		Pool:       key.pool,
+		Query:      key.query,
+		Count:      e.count,
+		ErrorCount: e.errors,
+		P50:        dbPercentile(samples, 0.50),
+		P95:        dbPercentile(samples, 0.95),
+		P99:        dbPercentile(samples, 0.99),
+		Max:        e.max,
+	}
+}
+
+func sortDBQueryStats(stats []DBQueryStat) {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Pool != stats[j].Pool {
+			return stats[i].Pool < stats[j].Pool
+		}
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return stats[i].Query < stats[j].Query
+	})
+}
+
+//sorted为升序
+func dbPercentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted))*p+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+var (
+	dbInListRegexp = regexp.MustCompile(`\(\?(?:, ?\?)*\)`)
+	dbMultiRegexp  = regexp.MustCompile(`\(\.\.\.\)(?:, ?\(\.\.\.\))+`)
+)
+
+//归一化sql用于统计：字符串和数字替换为?，合并空白，IN列表和多行VALUES合并为(...)
+func NormalizeSQL(query string) string {
+	buf := strings.Builder{}
+	space := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = buf.Len() > 0
+			continue
+		}
+		if space {
+			buf.WriteByte(' ')
+			space = false
+		}
+		switch {
+		case c == '\'' || c == '"':
+			//字符串，支持反斜杠转义和连续两个引号
+			for i++; i < len(query); i++ {
+				if query[i] == '\\' {
+					i++
+				} else if query[i] == c {
+					if i+1 < len(query) && query[i+1] == c {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			buf.WriteByte('?')
+		case c == '`':
+			j := strings.IndexByte(query[i+1:], '`')
+			if j < 0 {
+				buf.WriteString(query[i:])
+				i = len(query)
+				break
+			}
+			buf.WriteString(query[i : i+j+2])
+			i += j + 1
+		case c >= '0' && c <= '9' && (i == 0 || !dbIsNameChar(query[i-1])):
+			for i+1 < len(query) && dbIsNameChar(query[i+1]) {
+				i++
+			}
+			buf.WriteByte('?')
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	s := dbInListRegexp.ReplaceAllString(buf.String(), "(...)")
+	return dbMultiRegexp.ReplaceAllString(s, "(...)")
+}
+
+//按DBQueryStatsInterval定期打印有新查询的语句统计
+func startDBStatsLog() {
+	dbStatLogMu.Lock()
+	defer dbStatLogMu.Unlock()
+	if dbStatLogStop != nil || DBQueryStatsInterval <= 0 {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func(interval time.Duration) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				logDBQueryStats()
+			}
+		}
+	}(DBQueryStatsInterval)
+	dbStatLogStop, dbStatLogDone = stop, done
+}
+
+func stopDBStatsLog() {
+	dbStatLogMu.Lock()
+	defer dbStatLogMu.Unlock()
+	if dbStatLogStop == nil {
+		return
+	}
+	close(dbStatLogStop)
+	<-dbStatLogDone
+	dbStatLogStop, dbStatLogDone = nil, nil
+}
+
+func logDBQueryStats() {
+	dbStatMu.Lock()
+	stats := []DBQueryStat{}
+	for key, entry := range dbStatMap {
+		if entry.count == entry.logged {
+			continue
+		}
+		entry.logged = entry.count
+		stats = append(stats, entry.stat(key))
+	}
+	dbStatMu.Unlock()
+	sortDBQueryStats(stats)
+	trace := NewTrace()
+	for _, stat := range stats {
+		Log.TagInfo(trace, DLTagMysqlStats, map[string]interface{}{
+			"pool":        stat.Pool,
+			"sql":         stat.Query,
+			"count":       stat.Count,
+			"error_count": stat.ErrorCount,
+			"p50":         fmt.Sprintf("%fs", stat.P50.Seconds()),
+			"p95":         fmt.Sprintf("%fs", stat.P95.Seconds()),
+			"p99":         fmt.Sprintf("%fs", stat.P99.Seconds()),
+			"max":         fmt.Sprintf("%fs", stat.Max.Seconds()),
+		})
+	}
+}
+
+//*sql.DB对应的连接池名称，从库返回主库的名称
+func dbPoolName(db *sql.DB) string {
+	for name, pool := range DBMapPool {
+		if pool == db {
+			return name
+		}
+	}
+	dbClusterMu.RLock()
+	defer dbClusterMu.RUnlock()
+	for name, c := range dbClusterMap {
+		for _, r := range c.replicas {
+			if r.db == db {
+				return name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package tool
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/e421083458/gorm"
+)
+
+func TestNormalizeSQL(t *testing.T) {
+	cases := map[string]string{
+		"select * from user where id=1":                                  "select * from user where id=?",
+		"select *  from\n\tuser where name='a''b' and t1.x = \"c\\\"d\"": "select * from user where name=? and t1.x = ?",
+		"select * from user where id in (1, 2, 3)":                       "select * from user where id in (...)",
+		"select * from user where id in (?,?)":                           "select * from user where id in (...)",
+		"insert into user (name, age) values ('a', 1), ('b', 2)":         "insert into user (name, age) values (...)",
+		"select `1col` from t2 limit 10, 0x1F":                           "select `1col` from t2 limit ?, ?",
+	}
+	for in, want := range cases {
+		if got := NormalizeSQL(in); got != want {
+			t.Errorf("NormalizeSQL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestInterpolateSQL(t *testing.T) {
+	got := interpolateSQL("select * from user where id=? and name=? and email=?", []interface{}{1, []byte("a"), nil})
+	if want := "select * from user where id='1' and name='a' and email=NULL"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	got = interpolateSQL("select * from user where id=$1 and age>$2", []interface{}{1, 2})
+	if want := "select * from user where id='1' and age>'2'"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestDBQueryStats(t *testing.T) {
+	ResetDBQueryStats()
+	SetDBSlowThreshold("stats_test", time.Nanosecond)
+	defer SetDBSlowThreshold("stats_test", 0)
+	newFakeDBPool(t, "stats_test", func(query string, args []driver.Value) fakeDBResult {
+		if len(args) > 0 && args[0] == int64(0) {
+			return fakeDBResult{err: errors.New("bad id")}
+		}
+		return fakeDBResult{columns: []string{"name"}, rows: [][]driver.Value{{"a"}}}
+	})
+	ctx := context.Background()
+	var name string
+	for i := 0; i < 10; i++ {
+		DBQueryRow(ctx, nil, "stats_test", &name, "select name from user where id=?", i)
+	}
+	DBQueryRow(ctx, nil, "stats_test", &name, "select name from user where  id=5")
+
+	stats := GetDBQueryStats()
+	if len(stats) != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+	s := stats[0]
+	if s.Pool != "stats_test" || s.Query != "select name from user where id=?" || s.Count != 11 || s.ErrorCount != 1 {
+		t.Fatalf("stat %+v", s)
+	}
+	if s.P50 <= 0 || s.P50 > s.P95 || s.P95 > s.P99 || s.P99 > s.Max {
+		t.Fatalf("percentiles %+v", s)
+	}
+	logDBQueryStats()
+}
+
+func TestDBGormQueryStats(t *testing.T) {
+	ResetDBQueryStats()
+	newFakeDBPool(t, "gorm_stats_test", func(query string, args []driver.Value) fakeDBResult {
+		return fakeDBResult{}
+	})
+	sqlDB := DBMapPool["gorm_stats_test"]
+	delete(DBMapPool, "gorm_stats_test")
+	defer sqlDB.Close()
+	db, err := gorm.Open("mysql", sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &MysqlGormLogger{Trace: NewTrace(), Pool: "gorm_stats_test"}
+	query := "select name from user where id=?"
+	logQuery := func(err error) {
+		stmt := db.New()
+		stmt.Error = err
+		logger.CtxPrint(stmt, "sql", "mysql_stats_test.go", time.Millisecond, query, []interface{}{1}, int64(0))
+	}
+	logQuery(nil)
+	//查询不到记录不算失败
+	logQuery(gorm.ErrRecordNotFound)
+	logQuery(errors.New("Error 1146: Table 'user' doesn't exist"))
+
+	stats := GetDBQueryStats()
+	if len(stats) != 1 || stats[0].Pool != "gorm_stats_test" || stats[0].Count != 3 || stats[0].ErrorCount != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestDBPercentile(t *testing.T) {
+	samples := make([]time.Duration, 100)
+	for i := range samples {
+		samples[i] = time.Duration(i+1) * time.Millisecond
+	}
+	if p := dbPercentile(samples, 0.5); p != 50*time.Millisecond {
+		t.Fatalf("p50 %v", p)
+	}
+	if p := dbPercentile(samples, 0.99); p != 99*time.Millisecond {
+		t.Fatalf("p99 %v", p)
+	}
+	if p := dbPercentile(samples[:1], 0.99); p != time.Millisecond {
+		t.Fatalf("p99 of one sample %v", p)
+	}
+}
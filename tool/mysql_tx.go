@@ -0,0 +1,316 @@
+package tool
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"time"
+
+	"github.com/e421083458/gorm"
+)
+
+const (
+	txMaxRetriesDefault = 3
+	txBackoffDefault    = 50 * time.Millisecond
+	txBackoffMax        = time.Second
+)
+
+//死锁（1213）、锁等待超时（1205）以及SQLSTATE 40001的错误可以重试整个事务
+var txRetryableRegexp = regexp.MustCompile(`Error (1213|1205)\b|\(40001\)|Deadlock found`)
+
+type TxOptions struct {
+	Isolation  sql.IsolationLevel   //隔离级别，默认使用数据库的设置，gorm事务不支持
+	ReadOnly   bool                 //只读事务，gorm事务不支持
+	MaxRetries int                  //死锁等错误的重试次数，默认3次，-1为不重试
+	Backoff    time.Duration        //第一次重试的等待时间，之后每次翻倍，默认50ms
+	Retryable  func(err error) bool //判断错误是否可以重试，默认为死锁、锁等待超时
+}
+
+func (o *TxOptions) maxRetries() int {
+	if o == nil || o.MaxRetries == 0 {
+		return txMaxRetriesDefault
+	}
+	if o.MaxRetries < 0 {
+		return 0
+	}
+	return o.MaxRetries
+}
+
+func (o *TxOptions) retryable(err error) bool {
+	if o != nil && o.Retryable != nil {
+		return o.Retryable(err)
+	}
+	return IsTxRetryable(err)
+}
+
+//第attempt次重试前的等待时间，带随机抖动
+func (o *TxOptions) backoff(attempt int) time.Duration {
+	base := txBackoffDefault
+	if o != nil && o.Backoff > 0 {
+		base = o.Backoff
+	}
+	d := base << uint(attempt)
+	if d > txBackoffMax || d <= 0 {
+		d = txBackoffMax
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+//是否为死锁、锁等待超时等可以重试整个事务的错误
+func IsTxRetryable(err error) bool {
+	return err != nil && txRetryableRegexp.MatchString(err.Error())
+}
+
+//database/sql事务，在WithTx的fn中使用
+type DBTx struct {
+	ctx   context.Context
+	trace *TraceContext
+	pool  string
+	tx    *sql.Tx
+	seq   *int //savepoint序号，嵌套事务共用
+}
+
+//底层的*sql.Tx
+func (t *DBTx) Tx() *sql.Tx {
+	return t.tx
+}
+
+func (t *DBTx) QueryRow(dest interface{}, query string, args ...interface{}) error {
+	return dbQueryRow(t.ctx, t.trace, t.pool, t.tx, dest, query, args...)
+}
+
+func (t *DBTx) Query(dest interface{}, query string, args ...interface{}) error {
+	return dbQuery(t.ctx, t.trace, t.pool, t.tx, dest, query, args...)
+}
+
+func (t *DBTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return dbExec(t.ctx, t.trace, t.pool, t.tx, query, args...)
+}
+
+func (t *DBTx) NamedQuery(dest interface{}, query string, arg interface{}) error {
+	q, args, err := DBNamed(query, arg)
+	if err != nil {
+		return err
+	}
+	return t.Query(dest, q, args...)
+}
+
+func (t *DBTx) NamedExec(query string, arg interface{}) (sql.Result, error) {
+	q, args, err := DBNamed(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return t.Exec(q, args...)
+}
+
+//嵌套事务：使用savepoint，fn返回错误或panic时回滚到savepoint，不影响外层事务
+func (t *DBTx) WithTx(fn func(tx *DBTx) error) error {
+	*t.seq++
+	sp := fmt.Sprintf("sp_%d", *t.seq)
+	nested := &DBTx{ctx: t.ctx, trace: t.trace, pool: t.pool, tx: t.tx, seq: t.seq}
+	return txSavepoint(t.trace, sp, func(stmt string) error {
+		_, err := t.tx.ExecContext(t.ctx, stmt)
+		return err
+	}, func() error {
+		return fn(nested)
+	})
+}
+
+//在事务中执行fn：fn返回nil时提交，返回错误或panic时回滚，panic会继续抛出
+//死锁等错误按opts重试整个事务，opts可以为nil
+func WithTx(trace *TraceContext, poolName string, opts *TxOptions, fn func(tx *DBTx) error) error {
+	return WithTxContext(context.Background(), trace, poolName, opts, fn)
+}
+
+func WithTxContext(ctx context.Context, trace *TraceContext, poolName string, opts *TxOptions, fn func(tx *DBTx) error) error {
+	db, err := GetDBPool(poolName)
+	if err != nil {
+		return err
+	}
+	if trace == nil {
+		trace = NewTrace()
+	}
+	var txOpts *sql.TxOptions
+	if opts != nil && (opts.Isolation != sql.LevelDefault || opts.ReadOnly) {
+		txOpts = &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly}
+	}
+	return txRetry(ctx, trace, poolName, opts, func(attempt int) error {
+		startExecTime := time.Now()
+		sqlTx, err := db.BeginTx(ctx, txOpts)
+		txLog(trace, poolName, "begin", "", attempt, startExecTime, err)
+		if err != nil {
+			return err
+		}
+		seq := 0
+		tx := &DBTx{ctx: ctx, trace: trace, pool: poolName, tx: sqlTx, seq: &seq}
+		return txRun(trace, poolName, attempt, sqlTx.Commit, sqlTx.Rollback, func() error {
+			return fn(tx)
+		})
+	})
+}
+
+//gorm事务，内嵌*gorm.DB，在WithGormTx的fn中使用
+type GormTx struct {
+	*gorm.DB
+	trace *TraceContext
+	seq   *int //savepoint序号，嵌套事务共用
+}
+
+//嵌套事务：使用savepoint，fn返回错误或panic时回滚到savepoint，不影响外层事务
+func (t *GormTx) WithTx(fn func(tx *GormTx) error) error {
+	*t.seq++
+	sp := fmt.Sprintf("sp_%d", *t.seq)
+	nested := &GormTx{DB: t.DB, trace: t.trace, seq: t.seq}
+	return txSavepoint(t.trace, sp, func(stmt string) error {
+		return t.DB.Exec(stmt).Error
+	}, func() error {
+		return fn(nested)
+	})
+}
+
+//在gorm事务中执行fn，行为与WithTx相同，事务中的sql日志使用同一个trace
+func WithGormTx(trace *TraceContext, poolName string, opts *TxOptions, fn func(tx *GormTx) error) error {
+	db, err := GetGormPool(poolName)
+	if err != nil {
+		return err
+	}
+	if trace == nil {
+		trace = NewTrace()
+	}
+	if opts != nil && (opts.Isolation != sql.LevelDefault || opts.ReadOnly) {
+		return errors.New("gorm transaction does not support isolation level or read only")
+	}
+	return txRetry(context.Background(), trace, poolName, opts, func(attempt int) error {
+		startExecTime := time.Now()
+		gormTx := db.SetCtx(trace).Begin()
+		txLog(trace, poolName, "begin", "", attempt, startExecTime, gormTx.Error)
+		if gormTx.Error != nil {
+			return gormTx.Error
+		}
+		seq := 0
+		tx := &GormTx{DB: gormTx, trace: trace, seq: &seq}
+		return txRun(trace, poolName, attempt, func() error {
+			return gormTx.Commit().Error
+		}, func() error {
+			return gormTx.Rollback().Error
+		}, func() error {
+			return fn(tx)
+		})
+	})
+}
+
+//按重试次数执行事务，只有可以重试的错误才重试
+func txRetry(ctx context.Context, trace *TraceContext, poolName string, opts *TxOptions, run func(attempt int) error) error {
+	maxRetries := opts.maxRetries()
+	for attempt := 0; ; attempt++ {
+		err := run(attempt)
+		if err == nil || attempt >= maxRetries || !opts.retryable(err) {
+			return err
+		}
+		wait := opts.backoff(attempt)
+		Log.TagWarn(trace, DLTagMysqlFailed, map[string]interface{}{
+			"tx":      "retry",
+			"pool":    poolName,
+			"attempt": attempt + 1,
+			"wait":    wait.String(),
+			"err":     err.Error(),
+		})
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+//执行fn并提交，fn返回错误或panic时回滚
+func txRun(trace *TraceContext, poolName string, attempt int, commit, rollback func() error, fn func() error) (err error) {
+	done := false
+	defer func() {
+		if done {
+			return
+		}
+		//fn发生panic
+		r := recover()
+		startExecTime := time.Now()
+		rbErr := rollback()
+		txLog(trace, poolName, "rollback", "", attempt, startExecTime, rbErr)
+		if r != nil {
+			panic(r)
+		}
+	}()
+	err = fn()
+	done = true
+	if err != nil {
+		startExecTime := time.Now()
+		rbErr := rollback()
+		txLog(trace, poolName, "rollback", "", attempt, startExecTime, rbErr)
+		return err
+	}
+	startExecTime := time.Now()
+	err = commit()
+	txLog(trace, poolName, "commit", "", attempt, startExecTime, err)
+	return err
+}
+
+//savepoint嵌套事务
+func txSavepoint(trace *TraceContext, sp string, exec func(stmt string) error, fn func() error) (err error) {
+	startExecTime := time.Now()
+	err = exec("SAVEPOINT " + sp)
+	txLog(trace, "", "savepoint", sp, 0, startExecTime, err)
+	if err != nil {
+		return err
+	}
+	done := false
+	defer func() {
+		if done {
+			return
+		}
+		r := recover()
+		startExecTime := time.Now()
+		rbErr := exec("ROLLBACK TO SAVEPOINT " + sp)
+		txLog(trace, "", "rollback", sp, 0, startExecTime, rbErr)
+		if r != nil {
+			panic(r)
+		}
+	}()
+	err = fn()
+	done = true
+	if err != nil {
+		startExecTime := time.Now()
+		rbErr := exec("ROLLBACK TO SAVEPOINT " + sp)
+		txLog(trace, "", "rollback", sp, 0, startExecTime, rbErr)
+		return err
+	}
+	startExecTime = time.Now()
+	err = exec("RELEASE SAVEPOINT " + sp)
+	txLog(trace, "", "release", sp, 0, startExecTime, err)
+	return err
+}
+
+//记录事务日志
+func txLog(trace *TraceContext, poolName, action, savepoint string, attempt int, startExecTime time.Time, err error) {
+	endExecTime := time.Now()
+	m := map[string]interface{}{
+		"tx":        action,
+		"proc_time": fmt.Sprintf("%fs", endExecTime.Sub(startExecTime).Seconds()),
+	}
+	if poolName != "" {
+		m["pool"] = poolName
+	}
+	if savepoint != "" {
+		m["savepoint"] = savepoint
+	}
+	if attempt > 0 {
+		m["attempt"] = attempt
+	}
+	if err != nil {
+		m["err"] = err.Error()
+		Log.TagError(trace, DLTagMysqlFailed, m)
+		return
+	}
+	Log.TagInfo(trace, DLTagMysqlSuccess, m)
+}
@@ -0,0 +1,73 @@
+package tool
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithTx(t *testing.T) {
+	deadlocks := 1
+	d := newFakeDBPool(t, "tx_test", func(query string, args []driver.Value) fakeDBResult {
+		switch {
+		case query == "update deadlock" && deadlocks > 0:
+			deadlocks--
+			return fakeDBResult{err: errors.New("Error 1213: Deadlock found when trying to get lock; try restarting transaction")}
+		case query == "update fail":
+			return fakeDBResult{err: errors.New("Error 1062: Duplicate entry")}
+		}
+		return fakeDBResult{affected: 1}
+	})
+	defer delete(DBMapPool, "tx_test")
+	opts := &TxOptions{Backoff: time.Millisecond}
+
+	err := WithTx(NewTrace(), "tx_test", opts, func(tx *DBTx) error {
+		if _, err := tx.Exec("update deadlock"); err != nil {
+			return err
+		}
+		//嵌套事务失败只回滚到savepoint
+		tx.WithTx(func(tx *DBTx) error {
+			_, err := tx.Exec("update fail")
+			return err
+		})
+		return tx.WithTx(func(tx *DBTx) error {
+			_, err := tx.Exec("update ok")
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "BEGIN,update deadlock,ROLLBACK," +
+		"BEGIN,update deadlock,SAVEPOINT sp_1,update fail,ROLLBACK TO SAVEPOINT sp_1," +
+		"SAVEPOINT sp_2,update ok,RELEASE SAVEPOINT sp_2,COMMIT"
+	if got := strings.Join(d.queries, ","); got != want {
+		t.Fatalf("got %s\nwant %s", got, want)
+	}
+
+	d.queries = nil
+	err = WithTx(NewTrace(), "tx_test", opts, func(tx *DBTx) error {
+		_, err := tx.Exec("update fail")
+		return err
+	})
+	if err == nil || strings.Join(d.queries, ",") != "BEGIN,update fail,ROLLBACK" {
+		t.Fatalf("non-retryable error should rollback once: %v %v", err, d.queries)
+	}
+
+	d.queries = nil
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic should be rethrown")
+			}
+		}()
+		WithTx(NewTrace(), "tx_test", nil, func(tx *DBTx) error {
+			panic("boom")
+		})
+	}()
+	if strings.Join(d.queries, ",") != "BEGIN,ROLLBACK" {
+		t.Fatalf("panic should rollback: %v", d.queries)
+	}
+}
@@ -4,55 +4,240 @@ import (
 	"fmt"
 	"github.com/gomodule/redigo/redis"
 	"github.com/pkg/errors"
+	"lib/tool/metrics"
 	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 )
 
-//连接redis
+//redis部署模式
+const (
+	RedisModeStandalone = "standalone" //单机或代理，使用proxy_list
+	RedisModeSentinel   = "sentinel"   //通过sentinel_list发现主节点
+	RedisModeCluster    = "cluster"    //redis cluster，使用cluster_list作为种子节点
+)
+
+//连接池空闲连接检测的默认间隔
+const redisTestOnBorrowDefault = 60
+
+//cluster模式的连接，key为配置名
+var redisClusterMap map[string]*redisCluster
+
+//设置默认超时时间
+func redisConfDefault(cfg *RedisConf) {
+	//未设置连接超时时间
+	if cfg.ConnTimeout == 0 {
+		cfg.ConnTimeout = 50
+	}
+	//未设置读超时时间
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = 100
+	}
+	//未设置写超时时间
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = 100
+	}
+}
+
+//按配置在proxy_list中随机选择一个host建立连接
+func redisDial(cfg *RedisConf) (redis.Conn, error) {
+	if len(cfg.ProxyList) == 0 {
+		return nil, errors.New("redis proxy_list is empty")
+	}
+	//在ProxyList随机获取一个host
+	randHost := cfg.ProxyList[rand.Intn(len(cfg.ProxyList))]
+	return redisDialAddr(cfg, randHost)
+}
+
+//按配置连接指定的地址
+func redisDialAddr(cfg *RedisConf, addr string) (redis.Conn, error) {
+	redisConfDefault(cfg)
+	//使用以下指定的参数连接redis
+	c, err := redis.Dial("tcp", addr,
+		redis.DialConnectTimeout(time.Duration(cfg.ConnTimeout)*time.Millisecond),
+		redis.DialReadTimeout(time.Duration(cfg.ReadTimeout)*time.Millisecond),
+		redis.DialWriteTimeout(time.Duration(cfg.WriteTimeout)*time.Millisecond))
+	if err != nil {
+		//建立失败
+		return nil, err
+	}
+	//使用密码
+	if cfg.Password != "" {
+		if _, err := c.Do("AUTH", cfg.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if cfg.Db != 0 {
+		if _, err := c.Do("SELECT", cfg.Db); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+//按配置生成连接池，check用于检测空闲时间过长的连接
+func newRedisPool(cfg *RedisConf, dial func() (redis.Conn, error), check func(c redis.Conn) error) *redis.Pool {
+	pool := &redis.Pool{
+		MaxIdle:         cfg.MaxIdle,
+		MaxActive:       cfg.MaxActive,
+		IdleTimeout:     time.Duration(cfg.IdleTimeout) * time.Second,
+		Wait:            cfg.Wait,
+		MaxConnLifetime: time.Duration(cfg.MaxConnLifeTime) * time.Second,
+		Dial:            dial,
+	}
+	//取出空闲时间超过test_on_borrow秒的连接时先检测，-1表示关闭检测
+	testOnBorrow := cfg.TestOnBorrow
+	if testOnBorrow == 0 {
+		testOnBorrow = redisTestOnBorrowDefault
+	}
+	if testOnBorrow > 0 {
+		pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Duration(testOnBorrow)*time.Second {
+				return nil
+			}
+			return check(c)
+		}
+	}
+	return pool
+}
+
+func redisPing(c redis.Conn) error {
+	_, err := c.Do("PING")
+	return err
+}
+
+//初始化连接池，每个配置对应一个连接池
+func InitRedisPool() error {
+	CloseRedisPool()
+	RedisMapPool = map[string]*redis.Pool{}
+	redisClusterMap = map[string]*redisCluster{}
+	if ConfRedisMap == nil || len(ConfRedisMap.List) == 0 {
+		fmt.Printf("[INFO]%s%s\n", time.Now().Format(TimeFormat), "  redis config is empty")
+		return nil
+	}
+	for confName, cfg := range ConfRedisMap.List {
+		if err := ValidateRedisConf(confName, cfg); err != nil {
+			return err
+		}
+		switch cfg.Mode {
+		case "", RedisModeStandalone:
+			cfg := cfg
+			RedisMapPool[confName] = newRedisPool(cfg, func() (redis.Conn, error) {
+				return redisDial(cfg)
+			}, redisPing)
+		case RedisModeSentinel:
+			RedisMapPool[confName] = newRedisSentinel(cfg).newPool()
+		case RedisModeCluster:
+			cluster, err := newRedisCluster(cfg)
+			if err != nil {
+				return errors.Wrap(err, "init redis cluster "+confName)
+			}
+			redisClusterMap[confName] = cluster
+		}
+	}
+	return nil
+}
+
+//按模式检查redis配置，不建立连接
+func ValidateRedisConf(confName string, cfg *RedisConf) error {
+	if cfg == nil {
+		return errors.New("redis config is empty:" + confName)
+	}
+	switch cfg.Mode {
+	case "", RedisModeStandalone:
+		if len(cfg.ProxyList) == 0 {
+			return errors.New("redis proxy_list is empty:" + confName)
+		}
+	case RedisModeSentinel:
+		if len(cfg.SentinelList) == 0 || cfg.MasterName == "" {
+			return errors.New("redis sentinel_list or master_name is empty:" + confName)
+		}
+	case RedisModeCluster:
+		if len(cfg.ClusterList) == 0 {
+			return errors.New("redis cluster_list is empty:" + confName)
+		}
+		if cfg.Db != 0 {
+			return errors.New("redis cluster only supports db 0:" + confName)
+		}
+	default:
+		return errors.New("unknown redis mode:" + cfg.Mode)
+	}
+	return nil
+}
+
+func GetRedisPool(name string) (*redis.Pool, error) {
+	if pool, ok := RedisMapPool[name]; ok {
+		return pool, nil
+	}
+	return nil, errors.New("GetRedisPool error")
+}
+
+//关闭全部连接池
+func CloseRedisPool() error {
+	for _, pool := range RedisMapPool {
+		pool.Close()
+	}
+	for _, cluster := range redisClusterMap {
+		cluster.Close()
+	}
+	RedisMapPool = nil
+	redisClusterMap = nil
+	return nil
+}
+
+//获取全部连接池的统计信息，cluster模式按"配置名@节点地址"分别统计
+func RedisPoolStats() map[string]redis.PoolStats {
+	stats := map[string]redis.PoolStats{}
+	for confName, pool := range RedisMapPool {
+		stats[confName] = pool.Stats()
+	}
+	for confName, cluster := range redisClusterMap {
+		for addr, stat := range cluster.Stats() {
+			stats[confName+"@"+addr] = stat
+		}
+	}
+	return stats
+}
+
+//连接redis：优先从连接池获取，未初始化连接池时直接建立连接
 func RedisConnFactory(name string) (redis.Conn, error) {
+	if cluster, ok := redisClusterMap[name]; ok {
+		return cluster.Conn(), nil
+	}
+	if pool, ok := RedisMapPool[name]; ok {
+		c := pool.Get()
+		if err := c.Err(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	return redisDialName(name, "")
+}
+
+//按配置名建立不经过连接池的独立连接，用于订阅、阻塞读取等长连接场景
+//cluster模式下连接key所在的节点，key为空时连接任意节点
+func redisDialName(name string, key string) (redis.Conn, error) {
+	if cluster, ok := redisClusterMap[name]; ok {
+		slot := -1
+		if key != "" {
+			slot = RedisClusterSlot(key)
+		}
+		return redisDialAddr(cluster.cfg, cluster.addrOf(slot))
+	}
 	if ConfRedisMap != nil && ConfRedisMap.List != nil {
-		for confName, cfg := range ConfRedisMap.List {
-			//如果redis服务已经存在
-			if name == confName {
-				//在ProxyList随机获取一个host
-				randHost := cfg.ProxyList[rand.Intn(len(cfg.ProxyList))]
-				//未设置连接超时时间
-				if cfg.ConnTimeout == 0 {
-					cfg.ConnTimeout = 50
-				}
-				//未设置读超时时间
-				if cfg.ReadTimeout == 0 {
-					cfg.ReadTimeout = 100
-				}
-				//未设置写超时时间
-				if cfg.WriteTimeout == 0 {
-					cfg.WriteTimeout = 100
-				}
-				//使用以下指定的参数连接redis
-				c, err := redis.Dial("tcp", randHost,
-					redis.DialConnectTimeout(time.Duration(cfg.ConnTimeout)*time.Millisecond),
-					redis.DialReadTimeout(time.Duration(cfg.ReadTimeout)*time.Millisecond),
-					redis.DialWriteTimeout(time.Duration(cfg.WriteTimeout)*time.Millisecond))
-				if err != nil {
-					//建立失败
-					return nil, err
-				}
-				//使用密码
-				if cfg.Password != "" {
-					if _, err := c.Do("AUTH", cfg.Password); err != nil {
-						c.Close()
-						return nil, err
-					}
-				}
-				if cfg.Db != 0 {
-					if _, err := c.Do("SELECT", cfg.Db); err != nil {
-						c.Close()
-						return nil, err
-					}
-				}
-				return c, nil
+		//如果redis服务已经存在
+		if cfg, ok := ConfRedisMap.List[name]; ok {
+			switch cfg.Mode {
+			case RedisModeSentinel:
+				return newRedisSentinel(cfg).dial()
+			case RedisModeCluster:
+				return nil, errors.New("redis cluster is not initialized:" + name)
 			}
-
+			return redisDial(cfg)
 		}
 	}
 	return nil, errors.New("create redis conn failed")
@@ -63,8 +248,9 @@ func RedisLogDo(trace *TraceContext, c redis.Conn, commandName string, args ...i
 	startTime := time.Now()
 	replay, err := c.Do(commandName, args...)
 	endExecTime := time.Now()
+	metrics.ObserveRedisCommand(commandName, err, endExecTime.Sub(startTime))
 	if err != nil {
-		Log.TagError(trace, "_com_redis_failure", map[string]interface{}{
+		Log.TagError(trace, DLTagRedisFailed, map[string]interface{}{
 			"method":    commandName,
 			"err":       err,
 			"bind":      args,
@@ -72,11 +258,10 @@ func RedisLogDo(trace *TraceContext, c redis.Conn, commandName string, args ...i
 		})
 	} else {
 		//将请求应答转换为string
-		replyStr, _ := redis.String(replay, nil)
-		Log.TagInfo(trace, "_com_redis_success", map[string]interface{}{
+		Log.TagInfo(trace, DLTagredisSuccess, map[string]interface{}{
 			"method":    commandName,
 			"bind":      args,
-			"reply":     replyStr,
+			"reply":     redisReplyString(replay),
 			"proc_time": fmt.Sprintf("%fs", endExecTime.Sub(startTime).Seconds()),
 		})
 
@@ -88,32 +273,192 @@ func RedisLogDo(trace *TraceContext, c redis.Conn, commandName string, args ...i
 func RedisConfDo(trace *TraceContext, name string, commandName string, args ...interface{}) (interface{}, error) {
 	c, err := RedisConnFactory(name)
 	if err != nil {
-		Log.TagError(trace, "_com_redis_failure", map[string]interface{}{
+		Log.TagError(trace, DLTagRedisFailed, map[string]interface{}{
 			"method": commandName,
 			"err":    errors.New("RedisConnFactory error:" + name),
 		})
 		return nil, err
 	}
 	defer c.Close()
+	return RedisLogDo(trace, c, commandName, args...)
+}
+
+//将应答格式化为便于记录日志的字符串
+func redisReplyString(reply interface{}) string {
+	switch v := reply.(type) {
+	case nil:
+		return "nil"
+	case []byte:
+		return Substr(string(v), 0, 1024)
+	case string:
+		return Substr(v, 0, 1024)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case redis.Error:
+		return v.Error()
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, redisReplyString(item))
+		}
+		return Substr("["+strings.Join(items, " ")+"]", 0, 1024)
+	}
+	return fmt.Sprint(reply)
+}
+
+//批量执行的单条命令
+type RedisCmd struct {
+	Name string
+	Args []interface{}
+}
+
+//单条命令的执行结果
+type RedisResult struct {
+	Reply interface{}
+	Err   error
+}
+
+//将一批命令的结果汇总记录为一条日志
+func redisBatchLog(trace *TraceContext, method string, cmds []RedisCmd, results []RedisResult, err error, startTime time.Time) {
+	failures := []string{}
+	for i, result := range results {
+		if result.Err != nil {
+			failures = append(failures, fmt.Sprintf("%d:%s:%v", i, cmds[i].Name, result.Err))
+		}
+	}
+	bind := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		bind = append(bind, fmt.Sprintf("%s %v", cmd.Name, cmd.Args))
+	}
+	var metricErr error
+	if err != nil || len(failures) > 0 {
+		metricErr = errors.New("redis batch failed")
+	}
+	metrics.ObserveRedisCommand(method, metricErr, time.Since(startTime))
+	m := map[string]interface{}{
+		"method":    method,
+		"cmd_count": len(cmds),
+		"bind":      bind,
+		"proc_time": fmt.Sprintf("%fs", time.Since(startTime).Seconds()),
+	}
+	if err == nil && len(failures) == 0 {
+		Log.TagInfo(trace, DLTagredisSuccess, m)
+		return
+	}
+	if err != nil {
+		m["err"] = err
+	}
+	m["failures"] = failures
+	Log.TagError(trace, DLTagRedisFailed, m)
+}
 
+//以pipeline方式执行一批命令：Send/Flush/Receive
+//返回的error仅表示连接级别的错误，单条命令的错误在RedisResult.Err中
+func RedisPipeline(trace *TraceContext, c redis.Conn, cmds []RedisCmd) ([]RedisResult, error) {
 	startTime := time.Now()
-	reply, err := c.Do(commandName, args...)
-	endExecTime := time.Now()
+	results := make([]RedisResult, len(cmds))
+	err := func() error {
+		for _, cmd := range cmds {
+			if err := c.Send(cmd.Name, cmd.Args...); err != nil {
+				return err
+			}
+		}
+		if err := c.Flush(); err != nil {
+			return err
+		}
+		for i := range cmds {
+			reply, err := c.Receive()
+			if _, ok := err.(redis.Error); !ok && err != nil {
+				return err
+			}
+			results[i] = RedisResult{Reply: reply, Err: err}
+		}
+		return nil
+	}()
+	redisBatchLog(trace, "pipeline", cmds, results, err, startTime)
+	return results, err
+}
+
+//在MULTI/EXEC事务中执行一批命令
+//入队失败时整个事务被丢弃，对应命令的RedisResult.Err为入队错误
+func RedisTx(trace *TraceContext, c redis.Conn, cmds []RedisCmd) ([]RedisResult, error) {
+	startTime := time.Now()
+	results := make([]RedisResult, len(cmds))
+	err := func() error {
+		if err := c.Send("MULTI"); err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			if err := c.Send(cmd.Name, cmd.Args...); err != nil {
+				return err
+			}
+		}
+		if err := c.Send("EXEC"); err != nil {
+			return err
+		}
+		if err := c.Flush(); err != nil {
+			return err
+		}
+		if _, err := c.Receive(); err != nil {
+			return err
+		}
+		//读取QUEUED应答
+		for i := range cmds {
+			if _, err := c.Receive(); err != nil {
+				if _, ok := err.(redis.Error); !ok {
+					return err
+				}
+				results[i].Err = err
+			}
+		}
+		replies, err := redis.Values(c.Receive())
+		if err == redis.ErrNil {
+			//WATCH的key被修改，事务未执行
+			return errors.New("redis transaction aborted")
+		}
+		if err != nil {
+			return err
+		}
+		for i, reply := range replies {
+			if i >= len(results) {
+				break
+			}
+			if e, ok := reply.(redis.Error); ok {
+				results[i].Err = e
+				continue
+			}
+			results[i].Reply = reply
+		}
+		return nil
+	}()
+	redisBatchLog(trace, "multi", cmds, results, err, startTime)
+	return results, err
+}
+
+//通过配置以pipeline方式执行一批命令
+func RedisConfPipeline(trace *TraceContext, name string, cmds []RedisCmd) ([]RedisResult, error) {
+	c, err := RedisConnFactory(name)
 	if err != nil {
-		Log.TagError(trace, "_com_redis_failure", map[string]interface{}{
-			"method":    commandName,
-			"err":       err,
-			"bind":      args,
-			"proc_time": fmt.Sprintf("%fs", endExecTime.Sub(startTime).Seconds()),
+		Log.TagError(trace, DLTagRedisFailed, map[string]interface{}{
+			"method": "pipeline",
+			"err":    errors.New("RedisConnFactory error:" + name),
 		})
-	} else {
-		replyStr, _ := redis.String(reply, nil)
-		Log.TagInfo(trace, "_com_redis_success", map[string]interface{}{
-			"method":    commandName,
-			"bind":      args,
-			"reply":     replyStr,
-			"proc_time": fmt.Sprintf("%fs", endExecTime.Sub(startTime).Seconds()),
+		return nil, err
+	}
+	defer c.Close()
+	return RedisPipeline(trace, c, cmds)
+}
+
+//通过配置在MULTI/EXEC事务中执行一批命令
+func RedisConfTx(trace *TraceContext, name string, cmds []RedisCmd) ([]RedisResult, error) {
+	c, err := RedisConnFactory(name)
+	if err != nil {
+		Log.TagError(trace, DLTagRedisFailed, map[string]interface{}{
+			"method": "multi",
+			"err":    errors.New("RedisConnFactory error:" + name),
 		})
+		return nil, err
 	}
-	return reply, nil
+	defer c.Close()
+	return RedisTx(trace, c, cmds)
 }
@@ -0,0 +1,449 @@
+package tool
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	redisClusterSlots       = 16384
+	redisClusterMaxRedirect = 5
+)
+
+//cluster模式下直接执行SCAN返回的错误
+var ErrRedisClusterScan = errors.New("redis cluster SCAN must be run per node, use RedisClient.Scan")
+
+//cluster模式下不支持的命令：事务、订阅及切库需要固定在同一个连接上
+var redisClusterUnsupported = map[string]bool{
+	"MULTI": true, "EXEC": true, "DISCARD": true, "WATCH": true, "UNWATCH": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SELECT": true,
+}
+
+//cluster模式：维护slot到节点的映射，每个节点一个连接池
+type redisCluster struct {
+	cfg        *RedisConf
+	mu         sync.RWMutex
+	slots      []string               //slot -> 节点地址
+	pools      map[string]*redis.Pool //节点地址 -> 连接池
+	closed     bool                   //Close之后不再创建连接池
+	refreshing int32
+}
+
+func newRedisCluster(cfg *RedisConf) (*redisCluster, error) {
+	if len(cfg.ClusterList) == 0 {
+		return nil, errors.New("redis cluster_list is empty")
+	}
+	if cfg.Db != 0 {
+		return nil, errors.New("redis cluster only supports db 0")
+	}
+	c := &redisCluster{
+		cfg:   cfg,
+		slots: make([]string, redisClusterSlots),
+		pools: map[string]*redis.Pool{},
+	}
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//获取节点的连接池，不存在时创建，Close之后返回已关闭的连接池
+func (c *redisCluster) pool(addr string) *redis.Pool {
+	c.mu.RLock()
+	pool, ok := c.pools[addr]
+	c.mu.RUnlock()
+	if ok {
+		return pool
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pool, ok := c.pools[addr]; ok {
+		return pool
+	}
+	if c.closed {
+		//已关闭的连接池Get返回的连接执行命令时报错
+		pool = &redis.Pool{}
+		pool.Close()
+		return pool
+	}
+	pool = newRedisPool(c.cfg, func() (redis.Conn, error) {
+		return redisDialAddr(c.cfg, addr)
+	}, redisPing)
+	c.pools[addr] = pool
+	return pool
+}
+
+//通过CLUSTER SLOTS刷新slot映射，依次尝试已知节点及种子节点
+func (c *redisCluster) refresh() error {
+	c.mu.RLock()
+	addrs := make([]string, 0, len(c.pools)+len(c.cfg.ClusterList))
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.mu.RUnlock()
+	addrs = append(addrs, c.cfg.ClusterList...)
+
+	lastErr := errors.New("redis cluster has no available node")
+	for _, addr := range addrs {
+		slots, err := c.fetchSlots(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+		return nil
+	}
+	return lastErr
+}
+
+//后台刷新slot映射，同一时间只有一个刷新
+func (c *redisCluster) refreshAsync() {
+	c.mu.RLock()
+	closed := c.closed
+	c.mu.RUnlock()
+	if closed || !atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&c.refreshing, 0)
+		c.refresh()
+	}()
+}
+
+func (c *redisCluster) fetchSlots(addr string) ([]string, error) {
+	conn, err := redisDialAddr(c.cfg, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	seedHost, _, _ := net.SplitHostPort(addr)
+	slots := make([]string, redisClusterSlots)
+	for _, r := range ranges {
+		//[start, end, [host, port, id], replicas...]
+		entry, err := redis.Values(r, nil)
+		if err != nil || len(entry) < 3 {
+			return nil, errors.New("redis cluster invalid slots reply")
+		}
+		start, err1 := redis.Int(entry[0], nil)
+		end, err2 := redis.Int(entry[1], nil)
+		node, err3 := redis.Values(entry[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(node) < 2 ||
+			start < 0 || end >= redisClusterSlots || start > end {
+			return nil, errors.New("redis cluster invalid slots reply")
+		}
+		host, _ := redis.String(node[0], nil)
+		port, _ := redis.Int(node[1], nil)
+		if host == "" {
+			host = seedHost
+		}
+		nodeAddr := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = nodeAddr
+		}
+	}
+	return slots, nil
+}
+
+//slot所在节点，未知时随机选择一个节点
+func (c *redisCluster) addrOf(slot int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if slot >= 0 && c.slots[slot] != "" {
+		return c.slots[slot]
+	}
+	for _, addr := range c.slots {
+		if addr != "" {
+			return addr
+		}
+	}
+	return c.cfg.ClusterList[rand.Intn(len(c.cfg.ClusterList))]
+}
+
+func (c *redisCluster) setSlot(slot int, addr string) {
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+}
+
+//全部主节点的地址，按地址排序
+func (c *redisCluster) masters() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	seen := map[string]bool{}
+	addrs := []string{}
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+//在指定节点上执行命令，不处理重定向
+func (c *redisCluster) doAddr(addr string, commandName string, args ...interface{}) (interface{}, error) {
+	conn := c.pool(addr).Get()
+	defer conn.Close()
+	return conn.Do(commandName, args...)
+}
+
+//在全部主节点上执行KEYS并合并结果
+func (c *redisCluster) keys(args ...interface{}) (interface{}, error) {
+	keys := []interface{}{}
+	for _, addr := range c.masters() {
+		values, err := redis.Values(c.doAddr(addr, "KEYS", args...))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, values...)
+	}
+	return keys, nil
+}
+
+//按key路由执行命令，处理MOVED/ASK重定向
+//KEYS在全部主节点上执行，SCAN的cursor只在单个节点上有效，需要使用RedisClient.Scan按节点遍历
+func (c *redisCluster) do(commandName string, args ...interface{}) (interface{}, error) {
+	switch strings.ToUpper(commandName) {
+	case "KEYS":
+		return c.keys(args...)
+	case "SCAN":
+		return nil, ErrRedisClusterScan
+	}
+	slot := -1
+	if key, ok := redisClusterKey(commandName, args); ok {
+		slot = RedisClusterSlot(key)
+	}
+	addr := c.addrOf(slot)
+	asking := false
+	for i := 0; i <= redisClusterMaxRedirect; i++ {
+		conn := c.pool(addr).Get()
+		if asking {
+			conn.Send("ASKING")
+		}
+		reply, err := conn.Do(commandName, args...)
+		conn.Close()
+		redisErr, ok := err.(redis.Error)
+		if !ok {
+			return reply, err
+		}
+		kind, movedSlot, movedAddr, ok := parseRedisRedirect(redisErr)
+		if !ok {
+			return reply, err
+		}
+		if kind == "MOVED" {
+			c.setSlot(movedSlot, movedAddr)
+			c.refreshAsync()
+		}
+		addr = movedAddr
+		asking = kind == "ASK"
+	}
+	return nil, errors.New("redis cluster too many redirections")
+}
+
+//返回一个按命令路由的连接
+func (c *redisCluster) Conn() redis.Conn {
+	return &redisClusterConn{cluster: c}
+}
+
+func (c *redisCluster) Stats() map[string]redis.PoolStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats := map[string]redis.PoolStats{}
+	for addr, pool := range c.pools {
+		stats[addr] = pool.Stats()
+	}
+	return stats
+}
+
+func (c *redisCluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pool := range c.pools {
+		pool.Close()
+	}
+	c.pools = map[string]*redis.Pool{}
+	c.closed = true
+	return nil
+}
+
+//cluster模式的redis.Conn实现
+//每条命令单独路由，Send/Flush/Receive在Flush时按顺序逐条执行
+type redisClusterConn struct {
+	cluster *redisCluster
+	pending []RedisCmd
+	replies []RedisResult
+	err     error
+}
+
+func (c *redisClusterConn) Close() error {
+	if c.err == nil {
+		c.err = errors.New("redigo: closed")
+	}
+	c.pending = nil
+	c.replies = nil
+	return nil
+}
+
+func (c *redisClusterConn) Err() error {
+	return c.err
+}
+
+func (c *redisClusterConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	//与redigo一致：先执行未发送的命令并丢弃其应答
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	var reply interface{}
+	var err error
+	for _, r := range c.replies {
+		reply, err = r.Reply, r.Err
+	}
+	c.replies = nil
+	if commandName == "" {
+		return reply, err
+	}
+	if redisClusterUnsupported[strings.ToUpper(commandName)] {
+		return nil, errors.New("redis cluster unsupported command:" + commandName)
+	}
+	return c.cluster.do(commandName, args...)
+}
+
+func (c *redisClusterConn) Send(commandName string, args ...interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	if redisClusterUnsupported[strings.ToUpper(commandName)] {
+		return errors.New("redis cluster unsupported command:" + commandName)
+	}
+	c.pending = append(c.pending, RedisCmd{Name: commandName, Args: args})
+	return nil
+}
+
+func (c *redisClusterConn) Flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	for _, cmd := range c.pending {
+		reply, err := c.cluster.do(cmd.Name, cmd.Args...)
+		c.replies = append(c.replies, RedisResult{Reply: reply, Err: err})
+	}
+	c.pending = nil
+	return nil
+}
+
+func (c *redisClusterConn) Receive() (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if len(c.replies) == 0 {
+		if len(c.pending) == 0 {
+			return nil, errors.New("redis cluster no pending reply")
+		}
+		c.Flush()
+	}
+	r := c.replies[0]
+	c.replies = c.replies[1:]
+	return r.Reply, r.Err
+}
+
+//解析MOVED/ASK错误：MOVED 3999 127.0.0.1:6381
+func parseRedisRedirect(err redis.Error) (kind string, slot int, addr string, ok bool) {
+	parts := strings.Fields(string(err))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, convErr := strconv.Atoi(parts[1])
+	if convErr != nil || slot < 0 || slot >= redisClusterSlots {
+		return "", 0, "", false
+	}
+	return parts[0], slot, parts[2], true
+}
+
+//获取命令的路由key，无key的命令随机选择节点
+func redisClusterKey(commandName string, args []interface{}) (string, bool) {
+	switch strings.ToUpper(commandName) {
+	case "PING", "INFO", "TIME", "DBSIZE", "CLUSTER", "SCRIPT", "COMMAND", "ECHO", "RANDOMKEY":
+		return "", false
+	case "XREAD", "XREADGROUP":
+		//XREADGROUP GROUP group consumer [COUNT n] [BLOCK ms] [NOACK] STREAMS key ... id ...
+		for i, arg := range args {
+			if strings.EqualFold(redisArgString(arg), "STREAMS") && i+1 < len(args) {
+				return redisArgString(args[i+1]), true
+			}
+		}
+		return "", false
+	case "XGROUP", "XINFO", "OBJECT", "MEMORY", "BITOP":
+		//子命令之后为key，如XGROUP CREATE key group id
+		if len(args) < 2 {
+			return "", false
+		}
+		return redisArgString(args[1]), true
+	case "EVAL", "EVALSHA":
+		//EVAL script numkeys key ...
+		if len(args) < 3 {
+			return "", false
+		}
+		if n, err := strconv.Atoi(redisArgString(args[1])); err != nil || n == 0 {
+			return "", false
+		}
+		return redisArgString(args[2]), true
+	}
+	if len(args) == 0 {
+		return "", false
+	}
+	return redisArgString(args[0]), true
+}
+
+func redisArgString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(arg)
+}
+
+//计算key所在的slot，支持{hash tag}
+func RedisClusterSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % redisClusterSlots)
+}
+
+//CRC16/XMODEM
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
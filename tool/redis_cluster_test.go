@@ -0,0 +1,401 @@
+package tool
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+//本地模拟的RESP服务，handler返回原始RESP应答
+type fakeRedisServer struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	handler func(conn *fakeRedisConn, args []string) string
+}
+
+//每个客户端连接的状态
+type fakeRedisConn struct {
+	asking bool
+}
+
+func newFakeRedisServer(t *testing.T, handler func(conn *fakeRedisConn, args []string) string) *fakeRedisServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedisServer{ln: ln, handler: handler}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedisServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeRedisServer) Close() {
+	s.ln.Close()
+}
+
+func (s *fakeRedisServer) SetHandler(handler func(conn *fakeRedisConn, args []string) string) {
+	s.mu.Lock()
+	s.handler = handler
+	s.mu.Unlock()
+}
+
+func (s *fakeRedisServer) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	state := &fakeRedisConn{}
+	for {
+		args, err := readFakeRedisCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		handler := s.handler
+		s.mu.Unlock()
+		if _, err := io.WriteString(c, handler(state, args)); err != nil {
+			return
+		}
+	}
+}
+
+//读取一条*N\r\n$len\r\narg\r\n...格式的命令
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		//参数中可能包含换行，如EVAL的脚本
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args = append(args, string(arg[:size]))
+	}
+	return args, nil
+}
+
+func fakeBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func fakeRole(role string) string {
+	return "*1\r\n" + fakeBulk(role)
+}
+
+func TestRedisSentinelFailover(t *testing.T) {
+	master := newFakeRedisServer(t, func(conn *fakeRedisConn, args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "ROLE":
+			return fakeRole("master")
+		case "GET":
+			return fakeBulk("old")
+		}
+		return "+OK\r\n"
+	})
+	defer master.Close()
+	newMaster := newFakeRedisServer(t, func(conn *fakeRedisConn, args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "ROLE":
+			return fakeRole("master")
+		case "GET":
+			return fakeBulk("new")
+		}
+		return "+OK\r\n"
+	})
+	defer newMaster.Close()
+
+	current := master.Addr()
+	var mu sync.Mutex
+	sentinel := newFakeRedisServer(t, func(conn *fakeRedisConn, args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		host, port, _ := net.SplitHostPort(current)
+		return "*2\r\n" + fakeBulk(host) + fakeBulk(port)
+	})
+	defer sentinel.Close()
+
+	cfg := &RedisConf{
+		Mode:         RedisModeSentinel,
+		SentinelList: []string{"127.0.0.1:1", sentinel.Addr()},
+		MasterName:   "mymaster",
+		MaxIdle:      1,
+		TestOnBorrow: -1,
+	}
+	s := newRedisSentinel(cfg)
+	pool := s.newPool()
+	defer pool.Close()
+
+	c := pool.Get()
+	if v, err := redis.String(c.Do("GET", "k")); err != nil || v != "old" {
+		t.Fatalf("expected old, got %v %v", v, err)
+	}
+	c.Close()
+
+	//主节点降级为从节点，sentinel指向新的主节点
+	master.SetHandler(func(conn *fakeRedisConn, args []string) string {
+		return fakeRole("slave")
+	})
+	mu.Lock()
+	current = newMaster.Addr()
+	mu.Unlock()
+
+	//切换后立即取出的连接检测到旧主节点已降级，淘汰连接并重新查询sentinel
+	c = pool.Get()
+	if v, err := redis.String(c.Do("GET", "k")); err != nil || v != "new" {
+		t.Fatalf("expected new, got %v %v", v, err)
+	}
+	c.Close()
+	if s.addr() != newMaster.Addr() {
+		t.Fatalf("master not re-resolved, got %s", s.addr())
+	}
+}
+
+func TestRedisClusterRedirect(t *testing.T) {
+	node2 := newFakeRedisServer(t, nil)
+	defer node2.Close()
+	node2.SetHandler(func(conn *fakeRedisConn, args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "ASKING":
+			conn.asking = true
+			return "+OK\r\n"
+		case "GET":
+			if args[1] == "migrating" && !conn.asking {
+				return "-MOVED 1 127.0.0.1:1\r\n"
+			}
+			conn.asking = false
+			return fakeBulk("node2:" + args[1])
+		}
+		return "+OK\r\n"
+	})
+
+	node1 := newFakeRedisServer(t, nil)
+	defer node1.Close()
+	//slot迁移之后CLUSTER SLOTS返回的映射
+	movedSlot := RedisClusterSlot("moved")
+	var moved int32
+	slotRange := func(start, end int, addr string) string {
+		host, port, _ := net.SplitHostPort(addr)
+		return fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*2\r\n%s:%s\r\n", start, end, fakeBulk(host), port)
+	}
+	node1.SetHandler(func(conn *fakeRedisConn, args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "CLUSTER":
+			if atomic.LoadInt32(&moved) == 0 {
+				return "*1\r\n" + slotRange(0, 16383, node1.Addr())
+			}
+			return "*3\r\n" + slotRange(0, movedSlot-1, node1.Addr()) +
+				slotRange(movedSlot, movedSlot, node2.Addr()) + slotRange(movedSlot+1, 16383, node1.Addr())
+		case "GET":
+			switch args[1] {
+			case "moved":
+				atomic.StoreInt32(&moved, 1)
+				return fmt.Sprintf("-MOVED %d %s\r\n", movedSlot, node2.Addr())
+			case "migrating":
+				return fmt.Sprintf("-ASK %d %s\r\n", RedisClusterSlot("migrating"), node2.Addr())
+			}
+			return fakeBulk("node1:" + args[1])
+		}
+		return "+OK\r\n"
+	})
+
+	cluster, err := newRedisCluster(&RedisConf{Mode: RedisModeCluster, ClusterList: []string{node1.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+
+	c := cluster.Conn()
+	defer c.Close()
+	for key, expect := range map[string]string{
+		"local":     "node1:local",
+		"moved":     "node2:moved",
+		"migrating": "node2:migrating",
+	} {
+		if v, err := redis.String(c.Do("GET", key)); err != nil || v != expect {
+			t.Fatalf("GET %s expected %s, got %v %v", key, expect, v, err)
+		}
+	}
+	//MOVED之后slot映射已更新
+	if addr := cluster.addrOf(RedisClusterSlot("moved")); addr != node2.Addr() {
+		t.Fatalf("slot not updated after MOVED, got %s", addr)
+	}
+
+	//pipeline在cluster模式下逐条路由
+	results, err := RedisPipeline(NewTrace(), c, []RedisCmd{
+		{Name: "GET", Args: []interface{}{"local"}},
+		{Name: "GET", Args: []interface{}{"moved"}},
+	})
+	if err != nil || len(results) != 2 {
+		t.Fatalf("pipeline failed %v", err)
+	}
+	if v, _ := redis.String(results[1].Reply, results[1].Err); v != "node2:moved" {
+		t.Fatalf("unexpected pipeline reply %v", v)
+	}
+}
+
+func TestRedisClusterSlot(t *testing.T) {
+	//与redis官方文档中的示例一致
+	if slot := RedisClusterSlot("123456789"); slot != 0x31C3%redisClusterSlots {
+		t.Fatalf("unexpected slot %d", slot)
+	}
+	if RedisClusterSlot("{user1000}.following") != RedisClusterSlot("{user1000}.followers") {
+		t.Fatal("hash tag not applied")
+	}
+	if RedisClusterSlot("foo{}{bar}") != RedisClusterSlot("foo{}{bar}") ||
+		RedisClusterSlot("foo{}{bar}") == RedisClusterSlot("bar") {
+		t.Fatal("empty hash tag should hash the whole key")
+	}
+}
+
+func TestRedisClusterScanKeys(t *testing.T) {
+	var slots atomic.Value
+	node := func(name string, scan map[string]string) *fakeRedisServer {
+		return newFakeRedisServer(t, func(conn *fakeRedisConn, args []string) string {
+			switch strings.ToUpper(args[0]) {
+			case "CLUSTER":
+				return slots.Load().(string)
+			case "KEYS":
+				return "*1\r\n" + fakeBulk(name+"1")
+			case "SCAN":
+				return scan[args[1]]
+			}
+			return "+OK\r\n"
+		})
+	}
+	scanReply := func(cursor string, keys ...string) string {
+		reply := "*2\r\n" + fakeBulk(cursor) + fmt.Sprintf("*%d\r\n", len(keys))
+		for _, key := range keys {
+			reply += fakeBulk(key)
+		}
+		return reply
+	}
+	node1 := node("a", map[string]string{"0": scanReply("5", "a1"), "5": scanReply("0", "a2")})
+	defer node1.Close()
+	node2 := node("b", map[string]string{"0": scanReply("0", "b1")})
+	defer node2.Close()
+	slotRange := func(start, end int, addr string) string {
+		host, port, _ := net.SplitHostPort(addr)
+		return fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*2\r\n%s:%s\r\n", start, end, fakeBulk(host), port)
+	}
+	slots.Store("*2\r\n" + slotRange(0, 8191, node1.Addr()) + slotRange(8192, 16383, node2.Addr()))
+
+	cluster, err := newRedisCluster(&RedisConf{Mode: RedisModeCluster, ClusterList: []string{node1.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	oldClusterMap := redisClusterMap
+	defer func() { redisClusterMap = oldClusterMap }()
+	redisClusterMap = map[string]*redisCluster{"scan_test": cluster}
+
+	c := cluster.Conn()
+	defer c.Close()
+	//KEYS在全部主节点上执行
+	keys, err := redis.Strings(c.Do("KEYS", "*"))
+	sort.Strings(keys)
+	if err != nil || strings.Join(keys, ",") != "a1,b1" {
+		t.Fatalf("KEYS %v %v", keys, err)
+	}
+	if _, err := c.Do("SCAN", 0); err != ErrRedisClusterScan {
+		t.Fatalf("expected ErrRedisClusterScan, got %v", err)
+	}
+
+	it := NewRedisClient("scan_test").Scan(NewTrace(), "", 10)
+	keys = []string{}
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	sort.Strings(keys)
+	if it.Err() != nil || strings.Join(keys, ",") != "a1,a2,b1" {
+		t.Fatalf("scan %v %v", keys, it.Err())
+	}
+}
+
+func TestRedisClusterClose(t *testing.T) {
+	var slots atomic.Value
+	node := newFakeRedisServer(t, func(conn *fakeRedisConn, args []string) string {
+		if strings.ToUpper(args[0]) == "CLUSTER" {
+			return slots.Load().(string)
+		}
+		return "+OK\r\n"
+	})
+	defer node.Close()
+	host, port, _ := net.SplitHostPort(node.Addr())
+	slots.Store(fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n%s:%s\r\n", fakeBulk(host), port))
+	cluster, err := newRedisCluster(&RedisConf{Mode: RedisModeCluster, ClusterList: []string{node.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cluster.Conn()
+	if _, err := c.Do("SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	cluster.Close()
+
+	//关闭后刷新及执行命令不会重新创建连接池
+	cluster.refreshAsync()
+	c = cluster.Conn()
+	if _, err := c.Do("SET", "k", "v"); err == nil {
+		t.Fatal("expected error after close")
+	}
+	c.Close()
+	if stats := cluster.Stats(); len(stats) != 0 {
+		t.Fatalf("pools recreated after close: %v", stats)
+	}
+}
+
+func TestRedisClusterKey(t *testing.T) {
+	for _, tc := range []struct {
+		cmd  string
+		args []interface{}
+		key  string
+		ok   bool
+	}{
+		{"GET", []interface{}{"k"}, "k", true},
+		{"PING", nil, "", false},
+		{"EVAL", []interface{}{"return 1", 1, "k"}, "k", true},
+		{"EVAL", []interface{}{"return 1", 0}, "", false},
+		{"XREAD", []interface{}{"COUNT", 10, "STREAMS", "s", "0"}, "s", true},
+		{"XREADGROUP", []interface{}{"GROUP", "g", "c", "BLOCK", 100, "STREAMS", "s", ">"}, "s", true},
+		{"XGROUP", []interface{}{"CREATE", "s", "g", "$"}, "s", true},
+		{"XINFO", []interface{}{"STREAM", "s"}, "s", true},
+	} {
+		if key, ok := redisClusterKey(tc.cmd, tc.args); key != tc.key || ok != tc.ok {
+			t.Errorf("%s %v: got %q %v, want %q %v", tc.cmd, tc.args, key, ok, tc.key, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package tool
+
+import (
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+//基于配置名的类型化redis命令，所有命令都通过RedisConfDo记录日志
+//key不存在时返回redis.ErrNil
+type RedisClient struct {
+	name  string
+	codec RedisCodec
+}
+
+//按配置名生成客户端，使用RedisDefaultCodec编解码结构体
+func NewRedisClient(name string) *RedisClient {
+	return &RedisClient{name: name, codec: RedisDefaultCodec}
+}
+
+//返回使用指定编解码的客户端副本
+func (c *RedisClient) WithCodec(codec RedisCodec) *RedisClient {
+	return &RedisClient{name: c.name, codec: codec}
+}
+
+func (c *RedisClient) Name() string {
+	return c.name
+}
+
+func (c *RedisClient) Codec() RedisCodec {
+	return c.codec
+}
+
+func (c *RedisClient) Do(trace *TraceContext, commandName string, args ...interface{}) (interface{}, error) {
+	return RedisConfDo(trace, c.name, commandName, args...)
+}
+
+//ttl大于0时追加PX参数
+func redisTTLArgs(args []interface{}, ttl time.Duration) []interface{} {
+	if ttl > 0 {
+		args = append(args, "PX", int64(ttl/time.Millisecond))
+	}
+	return args
+}
+
+//string
+
+func (c *RedisClient) Get(trace *TraceContext, key string) (string, error) {
+	return redis.String(c.Do(trace, "GET", key))
+}
+
+func (c *RedisClient) GetBytes(trace *TraceContext, key string) ([]byte, error) {
+	return redis.Bytes(c.Do(trace, "GET", key))
+}
+
+//ttl为0时不过期
+func (c *RedisClient) Set(trace *TraceContext, key string, value interface{}, ttl time.Duration) error {
+	_, err := c.Do(trace, "SET", redisTTLArgs([]interface{}{key, value}, ttl)...)
+	return err
+}
+
+//key不存在时设置，返回是否设置成功
+func (c *RedisClient) SetNX(trace *TraceContext, key string, value interface{}, ttl time.Duration) (bool, error) {
+	args := redisTTLArgs([]interface{}{key, value}, ttl)
+	reply, err := redis.String(c.Do(trace, "SET", append(args, "NX")...))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return reply == "OK", err
+}
+
+//读取并解码到v
+func (c *RedisClient) GetObject(trace *TraceContext, key string, v interface{}) error {
+	data, err := c.GetBytes(trace, key)
+	if err != nil {
+		return err
+	}
+	return c.codec.Unmarshal(data, v)
+}
+
+//编码v后写入
+func (c *RedisClient) SetObject(trace *TraceContext, key string, v interface{}, ttl time.Duration) error {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Set(trace, key, data, ttl)
+}
+
+func (c *RedisClient) MGet(trace *TraceContext, keys ...string) ([]string, error) {
+	args := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	return redis.Strings(c.Do(trace, "MGET", args...))
+}
+
+func (c *RedisClient) Incr(trace *TraceContext, key string) (int64, error) {
+	return redis.Int64(c.Do(trace, "INCR", key))
+}
+
+func (c *RedisClient) IncrBy(trace *TraceContext, key string, delta int64) (int64, error) {
+	return redis.Int64(c.Do(trace, "INCRBY", key, delta))
+}
+
+func (c *RedisClient) Decr(trace *TraceContext, key string) (int64, error) {
+	return redis.Int64(c.Do(trace, "DECR", key))
+}
+
+//key
+
+//返回删除的key数量
+func (c *RedisClient) Del(trace *TraceContext, keys ...string) (int64, error) {
+	args := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	return redis.Int64(c.Do(trace, "DEL", args...))
+}
+
+func (c *RedisClient) Exists(trace *TraceContext, key string) (bool, error) {
+	return redis.Bool(c.Do(trace, "EXISTS", key))
+}
+
+//返回key是否存在
+func (c *RedisClient) Expire(trace *TraceContext, key string, ttl time.Duration) (bool, error) {
+	return redis.Bool(c.Do(trace, "PEXPIRE", key, int64(ttl/time.Millisecond)))
+}
+
+//TTL的返回值：key存在但未设置过期时间
+const RedisTTLNoExpire time.Duration = -1
+
+//剩余过期时间，key不存在返回redis.ErrNil，未设置过期时间返回RedisTTLNoExpire
+func (c *RedisClient) TTL(trace *TraceContext, key string) (time.Duration, error) {
+	ms, err := redis.Int64(c.Do(trace, "PTTL", key))
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case ms == -2:
+		return 0, redis.ErrNil
+	case ms < 0:
+		return RedisTTLNoExpire, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+//hash
+
+func (c *RedisClient) HGet(trace *TraceContext, key string, field string) (string, error) {
+	return redis.String(c.Do(trace, "HGET", key, field))
+}
+
+func (c *RedisClient) HSet(trace *TraceContext, key string, field string, value interface{}) error {
+	_, err := c.Do(trace, "HSET", key, field, value)
+	return err
+}
+
+func (c *RedisClient) HGetObject(trace *TraceContext, key string, field string, v interface{}) error {
+	data, err := redis.Bytes(c.Do(trace, "HGET", key, field))
+	if err != nil {
+		return err
+	}
+	return c.codec.Unmarshal(data, v)
+}
+
+func (c *RedisClient) HSetObject(trace *TraceContext, key string, field string, v interface{}) error {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.HSet(trace, key, field, data)
+}
+
+func (c *RedisClient) HMSet(trace *TraceContext, key string, fields map[string]interface{}) error {
+	_, err := c.Do(trace, "HMSET", redis.Args{}.Add(key).AddFlat(fields)...)
+	return err
+}
+
+func (c *RedisClient) HGetAll(trace *TraceContext, key string) (map[string]string, error) {
+	return redis.StringMap(c.Do(trace, "HGETALL", key))
+}
+
+func (c *RedisClient) HDel(trace *TraceContext, key string, fields ...string) (int64, error) {
+	return redis.Int64(c.Do(trace, "HDEL", redis.Args{}.Add(key).AddFlat(fields)...))
+}
+
+func (c *RedisClient) HExists(trace *TraceContext, key string, field string) (bool, error) {
+	return redis.Bool(c.Do(trace, "HEXISTS", key, field))
+}
+
+func (c *RedisClient) HIncrBy(trace *TraceContext, key string, field string, delta int64) (int64, error) {
+	return redis.Int64(c.Do(trace, "HINCRBY", key, field, delta))
+}
+
+func (c *RedisClient) HLen(trace *TraceContext, key string) (int64, error) {
+	return redis.Int64(c.Do(trace, "HLEN", key))
+}
+
+//list
+
+func (c *RedisClient) LPush(trace *TraceContext, key string, values ...interface{}) (int64, error) {
+	return redis.Int64(c.Do(trace, "LPUSH", redis.Args{}.Add(key).Add(values...)...))
+}
+
+func (c *RedisClient) RPush(trace *TraceContext, key string, values ...interface{}) (int64, error) {
+	return redis.Int64(c.Do(trace, "RPUSH", redis.Args{}.Add(key).Add(values...)...))
+}
+
+func (c *RedisClient) LPop(trace *TraceContext, key string) (string, error) {
+	return redis.String(c.Do(trace, "LPOP", key))
+}
+
+func (c *RedisClient) RPop(trace *TraceContext, key string) (string, error) {
+	return redis.String(c.Do(trace, "RPOP", key))
+}
+
+func (c *RedisClient) LRange(trace *TraceContext, key string, start int64, stop int64) ([]string, error) {
+	return redis.Strings(c.Do(trace, "LRANGE", key, start, stop))
+}
+
+func (c *RedisClient) LLen(trace *TraceContext, key string) (int64, error) {
+	return redis.Int64(c.Do(trace, "LLEN", key))
+}
+
+//set
+
+func (c *RedisClient) SAdd(trace *TraceContext, key string, members ...interface{}) (int64, error) {
+	return redis.Int64(c.Do(trace, "SADD", redis.Args{}.Add(key).Add(members...)...))
+}
+
+func (c *RedisClient) SRem(trace *TraceContext, key string, members ...interface{}) (int64, error) {
+	return redis.Int64(c.Do(trace, "SREM", redis.Args{}.Add(key).Add(members...)...))
+}
+
+func (c *RedisClient) SMembers(trace *TraceContext, key string) ([]string, error) {
+	return redis.Strings(c.Do(trace, "SMEMBERS", key))
+}
+
+func (c *RedisClient) SIsMember(trace *TraceContext, key string, member interface{}) (bool, error) {
+	return redis.Bool(c.Do(trace, "SISMEMBER", key, member))
+}
+
+func (c *RedisClient) SCard(trace *TraceContext, key string) (int64, error) {
+	return redis.Int64(c.Do(trace, "SCARD", key))
+}
+
+//sorted set
+
+//有序集合的成员及分数
+type RedisZMember struct {
+	Member string
+	Score  float64
+}
+
+func (c *RedisClient) ZAdd(trace *TraceContext, key string, members ...RedisZMember) (int64, error) {
+	args := redis.Args{}.Add(key)
+	for _, m := range members {
+		args = args.Add(m.Score, m.Member)
+	}
+	return redis.Int64(c.Do(trace, "ZADD", args...))
+}
+
+func (c *RedisClient) ZRem(trace *TraceContext, key string, members ...interface{}) (int64, error) {
+	return redis.Int64(c.Do(trace, "ZREM", redis.Args{}.Add(key).Add(members...)...))
+}
+
+func (c *RedisClient) ZScore(trace *TraceContext, key string, member string) (float64, error) {
+	return redis.Float64(c.Do(trace, "ZSCORE", key, member))
+}
+
+func (c *RedisClient) ZIncrBy(trace *TraceContext, key string, member string, delta float64) (float64, error) {
+	return redis.Float64(c.Do(trace, "ZINCRBY", key, delta, member))
+}
+
+func (c *RedisClient) ZCard(trace *TraceContext, key string) (int64, error) {
+	return redis.Int64(c.Do(trace, "ZCARD", key))
+}
+
+func (c *RedisClient) ZRange(trace *TraceContext, key string, start int64, stop int64) ([]string, error) {
+	return redis.Strings(c.Do(trace, "ZRANGE", key, start, stop))
+}
+
+func (c *RedisClient) ZRevRange(trace *TraceContext, key string, start int64, stop int64) ([]string, error) {
+	return redis.Strings(c.Do(trace, "ZREVRANGE", key, start, stop))
+}
+
+func (c *RedisClient) ZRangeWithScores(trace *TraceContext, key string, start int64, stop int64) ([]RedisZMember, error) {
+	return redisZMembers(c.Do(trace, "ZRANGE", key, start, stop, "WITHSCORES"))
+}
+
+//min、max支持"-inf"、"(1"等写法
+func (c *RedisClient) ZRangeByScore(trace *TraceContext, key string, min string, max string, offset int64, count int64) ([]RedisZMember, error) {
+	args := redis.Args{}.Add(key, min, max, "WITHSCORES")
+	if count > 0 {
+		args = args.Add("LIMIT", offset, count)
+	}
+	return redisZMembers(c.Do(trace, "ZRANGEBYSCORE", args...))
+}
+
+func redisZMembers(reply interface{}, err error) ([]RedisZMember, error) {
+	values, err := redis.Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]RedisZMember, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, err := redis.Float64([]byte(values[i+1]), nil)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, RedisZMember{Member: values[i], Score: score})
+	}
+	return members, nil
+}
+
+//scan
+
+//SCAN/HSCAN/SSCAN/ZSCAN迭代器，每次Next在缓存耗尽时请求下一批
+//cluster模式下SCAN依次遍历全部主节点
+type RedisScanIterator struct {
+	client  *RedisClient
+	trace   *TraceContext
+	command string
+	args    []interface{} //命令的前置参数，例如HSCAN的key
+	match   string
+	count   int64
+	pair    bool     //HSCAN、ZSCAN每个元素为field/value两项
+	nodes   []string //cluster模式下SCAN遍历的主节点
+	node    int
+	cursor  int64
+	started bool
+	buf     []string
+	key     string
+	val     string
+	err     error
+}
+
+func (c *RedisClient) newScanIterator(trace *TraceContext, command string, args []interface{}, match string, count int64, pair bool) *RedisScanIterator {
+	return &RedisScanIterator{
+		client:  c,
+		trace:   trace,
+		command: command,
+		args:    args,
+		match:   match,
+		count:   count,
+		pair:    pair,
+	}
+}
+
+//遍历key，match为空时不过滤，count为每批数量建议值
+func (c *RedisClient) Scan(trace *TraceContext, match string, count int64) *RedisScanIterator {
+	return c.newScanIterator(trace, "SCAN", nil, match, count, false)
+}
+
+//遍历hash，Key为field，Val为value
+func (c *RedisClient) HScan(trace *TraceContext, key string, match string, count int64) *RedisScanIterator {
+	return c.newScanIterator(trace, "HSCAN", []interface{}{key}, match, count, true)
+}
+
+func (c *RedisClient) SScan(trace *TraceContext, key string, match string, count int64) *RedisScanIterator {
+	return c.newScanIterator(trace, "SSCAN", []interface{}{key}, match, count, false)
+}
+
+//遍历有序集合，Key为member，Val为score
+func (c *RedisClient) ZScan(trace *TraceContext, key string, match string, count int64) *RedisScanIterator {
+	return c.newScanIterator(trace, "ZSCAN", []interface{}{key}, match, count, true)
+}
+
+//移动到下一个元素，遍历结束或出错时返回false
+func (it *RedisScanIterator) Next() bool {
+	for len(it.buf) == 0 {
+		if it.err != nil {
+			return false
+		}
+		if it.started && it.cursor == 0 {
+			if it.node+1 >= len(it.nodes) {
+				return false
+			}
+			//当前节点遍历结束，继续下一个节点
+			it.node++
+			it.started = false
+		}
+		args := redis.Args{}.Add(it.args...).Add(it.cursor)
+		if it.match != "" {
+			args = args.Add("MATCH", it.match)
+		}
+		if it.count > 0 {
+			args = args.Add("COUNT", it.count)
+		}
+		values, err := redis.Values(it.do(args))
+		if err == nil && len(values) != 2 {
+			err = redis.Error("invalid scan reply")
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		cursor, err := redis.Int64(values[0], nil)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		items, err := redis.Strings(values[1], nil)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.cursor = cursor
+		it.started = true
+		it.buf = items
+	}
+	it.key, it.val = it.buf[0], ""
+	it.buf = it.buf[1:]
+	if it.pair && len(it.buf) > 0 {
+		it.val = it.buf[0]
+		it.buf = it.buf[1:]
+	}
+	return true
+}
+
+//cluster模式下SCAN在当前节点上执行，其他命令按key路由
+func (it *RedisScanIterator) do(args []interface{}) (interface{}, error) {
+	if it.command == "SCAN" && !it.started && it.node == 0 {
+		if cluster, ok := redisClusterMap[it.client.name]; ok {
+			it.nodes = cluster.masters()
+		}
+	}
+	if len(it.nodes) == 0 {
+		return it.client.Do(it.trace, it.command, args...)
+	}
+	cluster, ok := redisClusterMap[it.client.name]
+	if !ok {
+		return nil, errors.New("redis cluster is not initialized:" + it.client.name)
+	}
+	conn := cluster.pool(it.nodes[it.node]).Get()
+	defer conn.Close()
+	return RedisLogDo(it.trace, conn, it.command, args...)
+}
+
+func (it *RedisScanIterator) Key() string {
+	return it.key
+}
+
+func (it *RedisScanIterator) Val() string {
+	return it.val
+}
+
+func (it *RedisScanIterator) Err() error {
+	return it.err
+}
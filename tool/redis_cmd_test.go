@@ -0,0 +1,179 @@
+package tool
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+//按完整命令返回固定应答的客户端
+func newFakeRedisClient(t *testing.T, name string, replies map[string]string) (*RedisClient, func()) {
+	srv := newFakeRedisServer(t, func(conn *fakeRedisConn, args []string) string {
+		if reply, ok := replies[strings.Join(args, " ")]; ok {
+			return reply
+		}
+		return "-ERR unexpected command " + strings.Join(args, " ") + "\r\n"
+	})
+	oldConf := ConfRedisMap
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{name: {ProxyList: []string{srv.Addr()}}}}
+	return NewRedisClient(name), func() {
+		ConfRedisMap = oldConf
+		srv.Close()
+	}
+}
+
+func TestRedisClientReply(t *testing.T) {
+	client, closeFn := newFakeRedisClient(t, "cmd_test", map[string]string{
+		"GET hit":                  fakeBulk("v"),
+		"GET miss":                 "$-1\r\n",
+		"SET k v PX 1500":          "+OK\r\n",
+		"SET nx v NX":              "+OK\r\n",
+		"SET exists v NX":          "$-1\r\n",
+		"MGET a b":                 "*2\r\n" + fakeBulk("1") + "$-1\r\n",
+		"INCR n":                   ":3\r\n",
+		"EXISTS k":                 ":1\r\n",
+		"PTTL expire":              ":1500\r\n",
+		"PTTL persist":             ":-1\r\n",
+		"PTTL miss":                ":-2\r\n",
+		"HGETALL h":                "*4\r\n" + fakeBulk("f1") + fakeBulk("v1") + fakeBulk("f2") + fakeBulk("v2"),
+		"ZSCORE z m":               fakeBulk("1.5"),
+		"ZSCORE z miss":            "$-1\r\n",
+		"ZRANGE z 0 -1 WITHSCORES": "*4\r\n" + fakeBulk("a") + fakeBulk("1") + fakeBulk("b") + fakeBulk("2.5"),
+		"ZRANGEBYSCORE z -inf +inf WITHSCORES LIMIT 0 1": "*2\r\n" + fakeBulk("a") + fakeBulk("1"),
+		"GET obj":    fakeBulk(`{"name":"lib","count":2}`),
+		"LPOP empty": "$-1\r\n",
+	})
+	defer closeFn()
+	trace := NewTrace()
+
+	type object struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	for _, tc := range []struct {
+		name string
+		call func() (interface{}, error)
+		want interface{}
+		err  error
+	}{
+		{"get", func() (interface{}, error) { return client.Get(trace, "hit") }, "v", nil},
+		{"get miss", func() (interface{}, error) { return client.Get(trace, "miss") }, "", redis.ErrNil},
+		{"set ttl", func() (interface{}, error) { return nil, client.Set(trace, "k", "v", 1500*time.Millisecond) }, nil, nil},
+		{"setnx", func() (interface{}, error) { return client.SetNX(trace, "nx", "v", 0) }, true, nil},
+		{"setnx exists", func() (interface{}, error) { return client.SetNX(trace, "exists", "v", 0) }, false, nil},
+		{"mget", func() (interface{}, error) { return client.MGet(trace, "a", "b") }, []string{"1", ""}, nil},
+		{"incr", func() (interface{}, error) { return client.Incr(trace, "n") }, int64(3), nil},
+		{"exists", func() (interface{}, error) { return client.Exists(trace, "k") }, true, nil},
+		{"ttl", func() (interface{}, error) { return client.TTL(trace, "expire") }, 1500 * time.Millisecond, nil},
+		{"ttl no expire", func() (interface{}, error) { return client.TTL(trace, "persist") }, RedisTTLNoExpire, nil},
+		{"ttl miss", func() (interface{}, error) { return client.TTL(trace, "miss") }, time.Duration(0), redis.ErrNil},
+		{"hgetall", func() (interface{}, error) { return client.HGetAll(trace, "h") }, map[string]string{"f1": "v1", "f2": "v2"}, nil},
+		{"zscore", func() (interface{}, error) { return client.ZScore(trace, "z", "m") }, 1.5, nil},
+		{"zscore miss", func() (interface{}, error) { return client.ZScore(trace, "z", "miss") }, float64(0), redis.ErrNil},
+		{"zrange withscores", func() (interface{}, error) { return client.ZRangeWithScores(trace, "z", 0, -1) },
+			[]RedisZMember{{Member: "a", Score: 1}, {Member: "b", Score: 2.5}}, nil},
+		{"zrangebyscore", func() (interface{}, error) { return client.ZRangeByScore(trace, "z", "-inf", "+inf", 0, 1) },
+			[]RedisZMember{{Member: "a", Score: 1}}, nil},
+		{"get object", func() (interface{}, error) {
+			v := object{}
+			err := client.GetObject(trace, "obj", &v)
+			return v, err
+		}, object{Name: "lib", Count: 2}, nil},
+		{"get object miss", func() (interface{}, error) {
+			v := object{}
+			err := client.GetObject(trace, "miss", &v)
+			return v, err
+		}, object{}, redis.ErrNil},
+		{"lpop empty", func() (interface{}, error) { return client.LPop(trace, "empty") }, "", redis.ErrNil},
+	} {
+		got, err := tc.call()
+		if err != tc.err {
+			t.Errorf("%s: err %v, want %v", tc.name, err, tc.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRedisScanIterator(t *testing.T) {
+	scanReply := func(cursor string, items ...string) string {
+		reply := "*2\r\n" + fakeBulk(cursor) + fmt.Sprintf("*%d\r\n", len(items))
+		for _, item := range items {
+			reply += fakeBulk(item)
+		}
+		return reply
+	}
+	client, closeFn := newFakeRedisClient(t, "scan_iter_test", map[string]string{
+		"SCAN 0 MATCH user:* COUNT 2": scanReply("7", "user:1", "user:2"),
+		"SCAN 7 MATCH user:* COUNT 2": scanReply("9"),
+		"SCAN 9 MATCH user:* COUNT 2": scanReply("0", "user:3"),
+		"HSCAN h 0":                   scanReply("3", "f1", "v1"),
+		"HSCAN h 3":                   scanReply("0", "f2", "v2"),
+		"SSCAN broken 0":              "-ERR wrong type\r\n",
+	})
+	defer closeFn()
+
+	collect := func(it *RedisScanIterator) []string {
+		items := []string{}
+		for it.Next() {
+			item := it.Key()
+			if it.Val() != "" {
+				item += "=" + it.Val()
+			}
+			items = append(items, item)
+		}
+		return items
+	}
+	//空批次不会提前结束遍历
+	it := client.Scan(NewTrace(), "user:*", 2)
+	if items := collect(it); it.Err() != nil || strings.Join(items, ",") != "user:1,user:2,user:3" {
+		t.Fatalf("scan %v %v", items, it.Err())
+	}
+	it = client.HScan(NewTrace(), "h", "", 0)
+	if items := collect(it); it.Err() != nil || strings.Join(items, ",") != "f1=v1,f2=v2" {
+		t.Fatalf("hscan %v %v", items, it.Err())
+	}
+	it = client.SScan(NewTrace(), "broken", "", 0)
+	if items := collect(it); len(items) != 0 || it.Err() == nil {
+		t.Fatalf("expected error, got %v %v", items, it.Err())
+	}
+}
+
+func TestRedisCodec(t *testing.T) {
+	type object struct {
+		Name  string
+		Tags  []string
+		Count int64
+		Score float64
+	}
+	in := object{Name: "lib", Tags: []string{"a", "b"}, Count: 3, Score: 1.5}
+	for name, codec := range map[string]RedisCodec{
+		"json":    RedisJSONCodec,
+		"gob":     RedisGobCodec,
+		"msgpack": RedisMsgpackCodec,
+	} {
+		data, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s marshal: %v", name, err)
+		}
+		out := object{}
+		if err := codec.Unmarshal(data, &out); err != nil {
+			t.Fatalf("%s unmarshal: %v", name, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("%s round trip got %+v", name, out)
+		}
+		if err := codec.Unmarshal([]byte("\xff\x00"), &out); err == nil {
+			t.Fatalf("%s: expected error for invalid data", name)
+		}
+	}
+	if client := NewRedisClient("codec_test").WithCodec(RedisGobCodec); client.Codec() != RedisGobCodec || client.Name() != "codec_test" {
+		t.Fatal("WithCodec should keep the name and replace the codec")
+	}
+}
@@ -0,0 +1,57 @@
+package tool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+//redis值的编解码，用于直接存取结构体
+type RedisCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	RedisJSONCodec    RedisCodec = redisJSONCodec{}
+	RedisGobCodec     RedisCodec = redisGobCodec{}
+	RedisMsgpackCodec RedisCodec = redisMsgpackCodec{}
+)
+
+//未指定编解码时使用的默认编解码
+var RedisDefaultCodec = RedisJSONCodec
+
+type redisJSONCodec struct{}
+
+func (redisJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (redisJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type redisGobCodec struct{}
+
+func (redisGobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (redisGobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type redisMsgpackCodec struct{}
+
+func (redisMsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (redisMsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,219 @@
+package tool
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+const (
+	DLTagRedisLockSuccess = "_com_redis_lock_success" //redis分布式锁操作成功
+	DLTagRedisLockFailed  = "_com_redis_lock_failure" //redis分布式锁操作失败
+)
+
+var (
+	ErrRedisLockNotAcquired = errors.New("redis lock not acquired") //锁已被其他持有者占用
+	ErrRedisLockNotHeld     = errors.New("redis lock not held")     //锁已过期或被其他持有者占用
+
+	errRedisLockTTL = errors.New("redis lock ttl must be at least 1ms")
+)
+
+//token一致时才删除，避免释放其他持有者的锁
+const redisUnlockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+//token一致时才续期
+const redisExtendScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`
+
+//阻塞获取锁时的默认重试间隔
+const redisLockRetryDefault = 50 * time.Millisecond
+
+//基于SET NX PX的分布式锁
+type RedisLock struct {
+	client   *RedisClient
+	trace    *TraceContext
+	key      string
+	token    string
+	ttl      time.Duration
+	mu       sync.Mutex
+	watchdog chan struct{}
+}
+
+func newRedisLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func redisLockLog(trace *TraceContext, action string, key string, err error, startTime time.Time) {
+	m := map[string]interface{}{
+		"action":    action,
+		"key":       key,
+		"proc_time": fmt.Sprintf("%fs", time.Since(startTime).Seconds()),
+	}
+	if err != nil {
+		m["err"] = err
+		Log.TagWarn(trace, DLTagRedisLockFailed, m)
+		return
+	}
+	Log.TagInfo(trace, DLTagRedisLockSuccess, m)
+}
+
+//尝试获取锁，已被占用时返回ErrRedisLockNotAcquired
+func RedisTryLock(trace *TraceContext, name string, key string, ttl time.Duration) (*RedisLock, error) {
+	startTime := time.Now()
+	lock, err := redisTryLock(trace, name, key, ttl)
+	redisLockLog(trace, "acquire", key, err, startTime)
+	return lock, err
+}
+
+func redisTryLock(trace *TraceContext, name string, key string, ttl time.Duration) (*RedisLock, error) {
+	if ttl < time.Millisecond {
+		return nil, errRedisLockTTL
+	}
+	token, err := newRedisLockToken()
+	if err != nil {
+		return nil, err
+	}
+	client := NewRedisClient(name)
+	ok, err := client.SetNX(trace, key, token, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrRedisLockNotAcquired
+	}
+	return &RedisLock{client: client, trace: trace, key: key, token: token, ttl: ttl}, nil
+}
+
+//阻塞获取锁，直到成功或ctx结束，retry为0时使用默认重试间隔
+func RedisLockWait(ctx context.Context, trace *TraceContext, name string, key string, ttl time.Duration, retry time.Duration) (*RedisLock, error) {
+	if retry <= 0 {
+		retry = redisLockRetryDefault
+	}
+	startTime := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			err := errors.Wrap(ctx.Err(), ErrRedisLockNotAcquired.Error())
+			redisLockLog(trace, "wait", key, err, startTime)
+			return nil, err
+		case <-timer.C:
+		}
+		lock, err := redisTryLock(trace, name, key, ttl)
+		if err == nil {
+			redisLockLog(trace, "wait", key, nil, startTime)
+			return lock, nil
+		}
+		if err != ErrRedisLockNotAcquired {
+			redisLockLog(trace, "wait", key, err, startTime)
+			return nil, err
+		}
+		timer.Reset(retry)
+	}
+}
+
+func (l *RedisLock) Key() string {
+	return l.key
+}
+
+func (l *RedisLock) Token() string {
+	return l.token
+}
+
+//续期为ttl，锁已丢失时返回ErrRedisLockNotHeld
+func (l *RedisLock) Extend(ttl time.Duration) error {
+	startTime := time.Now()
+	if ttl < time.Millisecond {
+		redisLockLog(l.trace, "extend", l.key, errRedisLockTTL, startTime)
+		return errRedisLockTTL
+	}
+	ok, err := redis.Bool(l.client.Do(l.trace, "EVAL", redisExtendScript, 1, l.key, l.token, int64(ttl/time.Millisecond)))
+	if err == nil && !ok {
+		err = ErrRedisLockNotHeld
+	}
+	if err == nil {
+		l.mu.Lock()
+		l.ttl = ttl
+		l.mu.Unlock()
+	}
+	redisLockLog(l.trace, "extend", l.key, err, startTime)
+	return err
+}
+
+//释放锁并停止看门狗，锁已丢失时返回ErrRedisLockNotHeld
+func (l *RedisLock) Unlock() error {
+	l.StopWatchdog()
+	startTime := time.Now()
+	ok, err := redis.Bool(l.client.Do(l.trace, "EVAL", redisUnlockScript, 1, l.key, l.token))
+	if err == nil && !ok {
+		err = ErrRedisLockNotHeld
+	}
+	redisLockLog(l.trace, "release", l.key, err, startTime)
+	return err
+}
+
+//启动看门狗，每隔interval续期一次，interval为0时取ttl的1/3
+//续期失败（锁已丢失）时调用onLost并退出，onLost可以为nil
+func (l *RedisLock) StartWatchdog(interval time.Duration, onLost func(err error)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.watchdog != nil {
+		return
+	}
+	if interval <= 0 {
+		interval = l.ttl / 3
+	}
+	stop := make(chan struct{})
+	l.watchdog = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				l.mu.Lock()
+				ttl := l.ttl
+				l.mu.Unlock()
+				err := l.Extend(ttl)
+				if err == ErrRedisLockNotHeld {
+					//退出后允许重新启动看门狗
+					l.mu.Lock()
+					if l.watchdog == stop {
+						l.watchdog = nil
+					}
+					l.mu.Unlock()
+					if onLost != nil {
+						onLost(err)
+					}
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (l *RedisLock) StopWatchdog() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.watchdog != nil {
+		close(l.watchdog)
+		l.watchdog = nil
+	}
+}
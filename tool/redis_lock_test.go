@@ -0,0 +1,234 @@
+package tool
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//支持GET、SET [PX ms] [NX]、DEL及分布式锁脚本的内存服务，按过期时间淘汰key
+type fakeKVRedis struct {
+	*fakeRedisServer
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+}
+
+func newFakeKVRedis(t *testing.T) *fakeKVRedis {
+	s := &fakeKVRedis{values: map[string]string{}, expires: map[string]time.Time{}}
+	s.fakeRedisServer = newFakeRedisServer(t, s.handle)
+	return s
+}
+
+func (s *fakeKVRedis) get(key string) (string, bool) {
+	if expire, ok := s.expires[key]; ok && !time.Now().Before(expire) {
+		delete(s.values, key)
+		delete(s.expires, key)
+	}
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *fakeKVRedis) set(key string, value string, ttl time.Duration) {
+	s.values[key] = value
+	delete(s.expires, key)
+	if ttl > 0 {
+		s.expires[key] = time.Now().Add(ttl)
+	}
+}
+
+func (s *fakeKVRedis) handle(conn *fakeRedisConn, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		v, ok := s.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fakeBulk(v)
+	case "SET":
+		var ttl time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				i++
+				ms, _ := strconv.Atoi(args[i])
+				if ms <= 0 {
+					return "-ERR invalid expire time in 'set' command\r\n"
+				}
+				ttl = time.Duration(ms) * time.Millisecond
+			}
+		}
+		if _, ok := s.get(args[1]); ok && nx {
+			return "$-1\r\n"
+		}
+		s.set(args[1], args[2], ttl)
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.get(key); ok {
+				delete(s.values, key)
+				delete(s.expires, key)
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "EVAL":
+		//EVAL script 1 key token [ttl]
+		if v, ok := s.get(args[3]); !ok || v != args[4] {
+			return ":0\r\n"
+		}
+		switch args[1] {
+		case redisUnlockScript:
+			delete(s.values, args[3])
+			delete(s.expires, args[3])
+		case redisExtendScript:
+			ms, _ := strconv.Atoi(args[5])
+			s.set(args[3], args[4], time.Duration(ms)*time.Millisecond)
+		default:
+			return "-ERR unknown script\r\n"
+		}
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func withFakeKVRedis(t *testing.T, name string) (*fakeKVRedis, func()) {
+	srv := newFakeKVRedis(t)
+	oldConf := ConfRedisMap
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{name: {ProxyList: []string{srv.Addr()}}}}
+	return srv, func() {
+		ConfRedisMap = oldConf
+		srv.Close()
+	}
+}
+
+func TestRedisLock(t *testing.T) {
+	_, closeFn := withFakeKVRedis(t, "lock_test")
+	defer closeFn()
+	trace := NewTrace()
+
+	if _, err := RedisTryLock(trace, "lock_test", "k", time.Microsecond); err == nil {
+		t.Fatal("ttl below 1ms should be rejected")
+	}
+	lock, err := RedisTryLock(trace, "lock_test", "k", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RedisTryLock(trace, "lock_test", "k", time.Second); err != ErrRedisLockNotAcquired {
+		t.Fatalf("expected ErrRedisLockNotAcquired, got %v", err)
+	}
+	if err := lock.Extend(time.Microsecond); err == nil {
+		t.Fatal("ttl below 1ms should be rejected")
+	}
+
+	//token不一致时不能释放其他持有者的锁
+	other := &RedisLock{client: NewRedisClient("lock_test"), trace: trace, key: "k", token: "other"}
+	if err := other.Unlock(); err != ErrRedisLockNotHeld {
+		t.Fatalf("expected ErrRedisLockNotHeld, got %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Unlock(); err != ErrRedisLockNotHeld {
+		t.Fatalf("expected ErrRedisLockNotHeld after release, got %v", err)
+	}
+
+	//过期后续期失败
+	lock, err = RedisTryLock(trace, "lock_test", "expire", 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if err := lock.Extend(time.Second); err != ErrRedisLockNotHeld {
+		t.Fatalf("expected ErrRedisLockNotHeld after expiry, got %v", err)
+	}
+}
+
+func TestRedisLockWatchdog(t *testing.T) {
+	srv, closeFn := withFakeKVRedis(t, "lock_watchdog_test")
+	defer closeFn()
+	trace := NewTrace()
+
+	lock, err := RedisTryLock(trace, "lock_watchdog_test", "k", 60*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.StartWatchdog(10*time.Millisecond, nil)
+	time.Sleep(150 * time.Millisecond)
+	if _, err := RedisTryLock(trace, "lock_watchdog_test", "k", time.Second); err != ErrRedisLockNotAcquired {
+		t.Fatalf("watchdog should keep the lock, got %v", err)
+	}
+
+	//锁丢失后看门狗退出，之后可以重新启动
+	lost := make(chan error, 1)
+	lock.StopWatchdog()
+	srv.mu.Lock()
+	srv.set("k", "stolen", 0)
+	srv.mu.Unlock()
+	lock.StartWatchdog(10*time.Millisecond, func(err error) { lost <- err })
+	select {
+	case err := <-lost:
+		if err != ErrRedisLockNotHeld {
+			t.Fatalf("onLost got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("onLost not called")
+	}
+	lock.mu.Lock()
+	running := lock.watchdog != nil
+	lock.mu.Unlock()
+	if running {
+		t.Fatal("watchdog should be cleared after the lock is lost")
+	}
+	var calls int32
+	lock.StartWatchdog(10*time.Millisecond, func(err error) { atomic.AddInt32(&calls, 1) })
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("restarted watchdog onLost called %d times", calls)
+	}
+}
+
+func TestRedisLockWait(t *testing.T) {
+	srv, closeFn := withFakeKVRedis(t, "lock_wait_test")
+	defer closeFn()
+	trace := NewTrace()
+
+	lock, err := RedisTryLock(trace, "lock_wait_test", "k", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := RedisLockWait(ctx, trace, "lock_wait_test", "k", time.Second, 10*time.Millisecond); errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	//锁被释放后等待者获得锁
+	time.AfterFunc(30*time.Millisecond, func() {
+		srv.mu.Lock()
+		delete(srv.values, "k")
+		srv.mu.Unlock()
+	})
+	waited, err := RedisLockWait(context.Background(), trace, "lock_wait_test", "k", time.Second, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited.Token() == lock.Token() {
+		t.Fatal("waiter should get a new token")
+	}
+	waited.Unlock()
+}
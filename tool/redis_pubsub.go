@@ -0,0 +1,588 @@
+package tool
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisReconnectMin   = 100 * time.Millisecond
+	redisReconnectMax   = 5 * time.Second
+	redisPubSubPingTime = 30 * time.Second //订阅连接的健康检查间隔
+)
+
+//断线重连的退避时间
+func redisBackoff(d time.Duration) time.Duration {
+	if d <= 0 {
+		return redisReconnectMin
+	}
+	d *= 2
+	if d > redisReconnectMax {
+		d = redisReconnectMax
+	}
+	return d
+}
+
+//等待d或收到stop信号，返回是否收到stop
+func redisSleep(stop chan struct{}, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+//pub/sub
+
+//订阅收到的消息，Pattern仅在PSUBSCRIBE时有值
+type RedisMessage struct {
+	Channel string
+	Pattern string
+	Data    []byte
+}
+
+//SUBSCRIBE/PSUBSCRIBE订阅，断线后自动重连并重新订阅
+type RedisSubscriber struct {
+	name     string
+	channels []string
+	patterns []string
+	handler  func(trace *TraceContext, msg RedisMessage)
+	mu       sync.Mutex
+	conn     redis.Conn
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+//按配置名订阅channels及patterns，每条消息使用新的TraceContext调用handler
+func NewRedisSubscriber(name string, channels []string, patterns []string, handler func(trace *TraceContext, msg RedisMessage)) *RedisSubscriber {
+	return &RedisSubscriber{
+		name:     name,
+		channels: channels,
+		patterns: patterns,
+		handler:  handler,
+	}
+}
+
+//在后台开始订阅
+func (s *RedisSubscriber) Start() error {
+	if len(s.channels) == 0 && len(s.patterns) == 0 {
+		return errors.New("redis subscriber has no channel")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return errors.New("redis subscriber already started")
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run()
+	return nil
+}
+
+//停止订阅并等待后台协程退出
+func (s *RedisSubscriber) Close() error {
+	s.mu.Lock()
+	if s.stop == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	close(s.stop)
+	if s.conn != nil {
+		//关闭连接以中断阻塞中的Receive
+		s.conn.Close()
+	}
+	done := s.done
+	s.mu.Unlock()
+	<-done
+	return nil
+}
+
+func (s *RedisSubscriber) run() {
+	defer close(s.done)
+	backoff := time.Duration(0)
+	for {
+		subscribed, err := s.subscribe()
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		//订阅成功过说明连接已恢复，重新从最小退避时间开始
+		if subscribed {
+			backoff = 0
+		}
+		backoff = redisBackoff(backoff)
+		Log.TagError(NewTrace(), DLTagRedisFailed, map[string]interface{}{
+			"method":    "subscribe",
+			"name":      s.name,
+			"channels":  s.channels,
+			"patterns":  s.patterns,
+			"err":       err,
+			"reconnect": backoff.String(),
+		})
+		if redisSleep(s.stop, backoff) {
+			return
+		}
+	}
+}
+
+//建立连接并订阅，连接断开后返回，subscribed为是否收到过订阅确认
+func (s *RedisSubscriber) subscribe() (subscribed bool, err error) {
+	c, err := redisDialName(s.name, "")
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	select {
+	case <-s.stop:
+		s.mu.Unlock()
+		c.Close()
+		return false, nil
+	default:
+	}
+	s.conn = c
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	psc := redis.PubSubConn{Conn: c}
+	if len(s.channels) > 0 {
+		if err := psc.Subscribe(redis.Args{}.AddFlat(s.channels)...); err != nil {
+			return false, err
+		}
+	}
+	if len(s.patterns) > 0 {
+		if err := psc.PSubscribe(redis.Args{}.AddFlat(s.patterns)...); err != nil {
+			return false, err
+		}
+	}
+	//定时PING做健康检查，读取超时大于PING间隔，连接正常时不会超时
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go func() {
+		ticker := time.NewTicker(redisPubSubPingTime)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pingDone:
+				return
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * redisPubSubPingTime).(type) {
+		case redis.Message:
+			trace := NewTrace()
+			Log.TagInfo(trace, DLTagredisSuccess, map[string]interface{}{
+				"method":  "subscribe_message",
+				"channel": v.Channel,
+				"pattern": v.Pattern,
+				"data":    Substr(string(v.Data), 0, 1024),
+			})
+			s.handle(trace, RedisMessage{Channel: v.Channel, Pattern: v.Pattern, Data: v.Data})
+		case redis.Subscription:
+			if v.Count == 0 {
+				return subscribed, errors.New("redis subscription closed")
+			}
+			subscribed = true
+		case redis.Pong:
+		case error:
+			return subscribed, v
+		}
+	}
+}
+
+//调用handler，panic时记录日志并继续接收后续消息
+func (s *RedisSubscriber) handle(trace *TraceContext, msg RedisMessage) {
+	defer func() {
+		if r := recover(); r != nil {
+			Log.TagError(trace, DLTagRedisFailed, map[string]interface{}{
+				"method":  "subscribe_message",
+				"channel": msg.Channel,
+				"pattern": msg.Pattern,
+				"err":     fmt.Sprintf("subscribe handler panic: %v", r),
+			})
+		}
+	}()
+	s.handler(trace, msg)
+}
+
+//发布消息，返回收到消息的订阅者数量
+func RedisPublish(trace *TraceContext, name string, channel string, message interface{}) (int64, error) {
+	return redis.Int64(RedisConfDo(trace, name, "PUBLISH", channel, message))
+}
+
+//streams
+
+//消费到的stream消息
+type RedisStreamMessage struct {
+	Stream string
+	ID     string
+	Values map[string]string
+}
+
+type RedisStreamOptions struct {
+	Count       int           //每次读取的最大条数，默认10
+	Block       time.Duration //XREADGROUP阻塞时间，默认5秒
+	StartID     string        //消费组不存在时创建的起始ID，默认"$"
+	MinIdle     time.Duration //pending消息空闲超过该时间后被当前消费者认领，默认1分钟
+	ClaimEvery  time.Duration //检查pending消息的间隔，默认30秒
+	MaxDelivery int64         //投递次数超过该值的消息直接ACK丢弃，0为不限制
+}
+
+//基于XREADGROUP的消费组消费者：handler返回nil时XACK，否则留在pending中等待重试
+type RedisStreamConsumer struct {
+	name     string
+	stream   string
+	group    string
+	consumer string
+	opts     RedisStreamOptions
+	handler  func(trace *TraceContext, msg RedisStreamMessage) error
+	mu       sync.Mutex
+	conn     redis.Conn
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewRedisStreamConsumer(name string, stream string, group string, consumer string, opts RedisStreamOptions,
+	handler func(trace *TraceContext, msg RedisStreamMessage) error) *RedisStreamConsumer {
+	if opts.Count <= 0 {
+		opts.Count = 10
+	}
+	if opts.Block <= 0 {
+		opts.Block = 5 * time.Second
+	}
+	if opts.StartID == "" {
+		opts.StartID = "$"
+	}
+	if opts.MinIdle <= 0 {
+		opts.MinIdle = time.Minute
+	}
+	if opts.ClaimEvery <= 0 {
+		opts.ClaimEvery = 30 * time.Second
+	}
+	return &RedisStreamConsumer{
+		name:     name,
+		stream:   stream,
+		group:    group,
+		consumer: consumer,
+		opts:     opts,
+		handler:  handler,
+	}
+}
+
+//在后台开始消费
+func (s *RedisStreamConsumer) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return errors.New("redis stream consumer already started")
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run()
+	return nil
+}
+
+//停止消费并等待后台协程退出
+func (s *RedisStreamConsumer) Close() error {
+	s.mu.Lock()
+	if s.stop == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	close(s.stop)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	done := s.done
+	s.mu.Unlock()
+	<-done
+	return nil
+}
+
+func (s *RedisStreamConsumer) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *RedisStreamConsumer) run() {
+	defer close(s.done)
+	backoff := time.Duration(0)
+	for {
+		connected, err := s.consume()
+		if s.stopped() {
+			return
+		}
+		//连接成功过说明已恢复，重新从最小退避时间开始
+		if connected {
+			backoff = 0
+		}
+		backoff = redisBackoff(backoff)
+		Log.TagError(NewTrace(), DLTagRedisFailed, map[string]interface{}{
+			"method":    "stream_consume",
+			"name":      s.name,
+			"stream":    s.stream,
+			"group":     s.group,
+			"err":       err,
+			"reconnect": backoff.String(),
+		})
+		if redisSleep(s.stop, backoff) {
+			return
+		}
+	}
+}
+
+//建立连接并循环消费，连接出错后返回，connected为是否成功创建或加入过消费组
+func (s *RedisStreamConsumer) consume() (connected bool, err error) {
+	c, err := redisDialName(s.name, s.stream)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	if s.stopped() {
+		s.mu.Unlock()
+		c.Close()
+		return false, nil
+	}
+	s.conn = c
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	_, err = c.Do("XGROUP", "CREATE", s.stream, s.group, s.opts.StartID, "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return false, err
+	}
+	//先处理本消费者未ACK的历史消息
+	if err := s.readGroup(c, "0"); err != nil {
+		return true, err
+	}
+	lastClaim := time.Time{}
+	for !s.stopped() {
+		if time.Since(lastClaim) >= s.opts.ClaimEvery {
+			if err := s.claim(c); err != nil {
+				return true, err
+			}
+			lastClaim = time.Now()
+		}
+		if err := s.readGroup(c, ">"); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+//id为">"时阻塞读取新消息，为"0"时读取本消费者的pending消息直到读完
+func (s *RedisStreamConsumer) readGroup(c redis.Conn, id string) error {
+	for {
+		args := redis.Args{}.Add("GROUP", s.group, s.consumer, "COUNT", s.opts.Count)
+		timeout := time.Duration(0)
+		if id == ">" {
+			args = args.Add("BLOCK", int64(s.opts.Block/time.Millisecond))
+			timeout = s.opts.Block + time.Second
+		}
+		args = args.Add("STREAMS", s.stream, id)
+		var reply interface{}
+		var err error
+		if timeout > 0 {
+			reply, err = redis.DoWithTimeout(c, timeout, "XREADGROUP", args...)
+		} else {
+			reply, err = c.Do("XREADGROUP", args...)
+		}
+		if err == redis.ErrNil || reply == nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msgs, err := redisStreamMessages(reply)
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if err := s.handle(c, msg); err != nil {
+				return err
+			}
+		}
+		if id == ">" || len(msgs) == 0 {
+			return nil
+		}
+		//继续读取下一批pending消息
+		id = msgs[len(msgs)-1].ID
+	}
+}
+
+//认领其他消费者空闲过久的pending消息
+func (s *RedisStreamConsumer) claim(c redis.Conn) error {
+	entries, err := redis.Values(c.Do("XPENDING", s.stream, s.group, "-", "+", s.opts.Count))
+	if err != nil {
+		return err
+	}
+	minIdle := int64(s.opts.MinIdle / time.Millisecond)
+	ids := redis.Args{}
+	for _, entry := range entries {
+		//[id, consumer, idle ms, deliveries]
+		fields, err := redis.Values(entry, nil)
+		if err != nil || len(fields) < 4 {
+			continue
+		}
+		id, _ := redis.String(fields[0], nil)
+		idle, _ := redis.Int64(fields[2], nil)
+		deliveries, _ := redis.Int64(fields[3], nil)
+		if idle < minIdle {
+			continue
+		}
+		if s.opts.MaxDelivery > 0 && deliveries > s.opts.MaxDelivery {
+			Log.TagError(NewTrace(), DLTagRedisFailed, map[string]interface{}{
+				"method":     "stream_drop",
+				"stream":     s.stream,
+				"group":      s.group,
+				"id":         id,
+				"deliveries": deliveries,
+			})
+			if _, err := c.Do("XACK", s.stream, s.group, id); err != nil {
+				return err
+			}
+			continue
+		}
+		ids = ids.Add(id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	reply, err := c.Do("XCLAIM", redis.Args{}.Add(s.stream, s.group, s.consumer, minIdle).Add(ids...)...)
+	if err != nil {
+		return err
+	}
+	msgs, err := redisStreamEntries(s.stream, reply)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := s.handle(c, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//调用handler，成功后XACK；返回的error仅表示连接错误
+func (s *RedisStreamConsumer) handle(c redis.Conn, msg RedisStreamMessage) error {
+	trace := NewTrace()
+	startTime := time.Now()
+	//已被删除的pending消息没有内容，直接ACK
+	var err error
+	if msg.Values != nil {
+		err = s.callHandler(trace, msg)
+	}
+	m := map[string]interface{}{
+		"method":    "stream_consume",
+		"stream":    msg.Stream,
+		"group":     s.group,
+		"id":        msg.ID,
+		"proc_time": fmt.Sprintf("%fs", time.Since(startTime).Seconds()),
+	}
+	if err != nil {
+		m["err"] = err
+		Log.TagError(trace, DLTagRedisFailed, m)
+		return nil
+	}
+	Log.TagInfo(trace, DLTagredisSuccess, m)
+	_, ackErr := c.Do("XACK", msg.Stream, s.group, msg.ID)
+	return ackErr
+}
+
+//handler发生panic时作为处理失败，消息留在pending中等待重试
+func (s *RedisStreamConsumer) callHandler(trace *TraceContext, msg RedisStreamMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("stream handler panic: %v", r)
+		}
+	}()
+	return s.handler(trace, msg)
+}
+
+//解析XREADGROUP应答：[[stream, [[id, [k, v, ...]], ...]], ...]
+func redisStreamMessages(reply interface{}) ([]RedisStreamMessage, error) {
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	msgs := []RedisStreamMessage{}
+	for _, stream := range streams {
+		fields, err := redis.Values(stream, nil)
+		if err != nil || len(fields) != 2 {
+			return nil, errors.New("redis invalid XREADGROUP reply")
+		}
+		name, err := redis.String(fields[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := redisStreamEntries(name, fields[1])
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, entries...)
+	}
+	return msgs, nil
+}
+
+//解析[[id, [k, v, ...]], ...]
+func redisStreamEntries(stream string, reply interface{}) ([]RedisStreamMessage, error) {
+	entries, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]RedisStreamMessage, 0, len(entries))
+	for _, entry := range entries {
+		//XCLAIM认领已删除的消息时返回nil
+		if entry == nil {
+			continue
+		}
+		fields, err := redis.Values(entry, nil)
+		if err != nil || len(fields) != 2 {
+			return nil, errors.New("redis invalid stream entry")
+		}
+		id, err := redis.String(fields[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		msg := RedisStreamMessage{Stream: stream, ID: id}
+		if fields[1] != nil {
+			if msg.Values, err = redis.StringMap(fields[1], nil); err != nil {
+				return nil, err
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+//向stream追加消息，返回消息ID
+func RedisStreamAdd(trace *TraceContext, name string, stream string, values map[string]interface{}) (string, error) {
+	return redis.String(RedisConfDo(trace, name, "XADD", redis.Args{}.Add(stream, "*").AddFlat(values)...))
+}
@@ -0,0 +1,159 @@
+package tool
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fakeArray(items ...string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(items))
+	for _, item := range items {
+		reply += fakeBulk(item)
+	}
+	return reply
+}
+
+func TestRedisSubscriber(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	subscribedAt := []time.Time{}
+	srv := newFakeRedisServer(t, func(conn *fakeRedisConn, args []string) string {
+		if strings.ToUpper(args[0]) != "SUBSCRIBE" {
+			return "+OK\r\n"
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		//前3次订阅失败，退避时间增长到400ms
+		if attempts <= 3 {
+			return "-ERR loading\r\n"
+		}
+		subscribedAt = append(subscribedAt, time.Now())
+		reply := "*3\r\n" + fakeBulk("subscribe") + fakeBulk("ch") + ":1\r\n" +
+			"*3\r\n" + fakeBulk("message") + fakeBulk("ch") + fakeBulk("panic") +
+			"*3\r\n" + fakeBulk("message") + fakeBulk("ch") + fakeBulk(fmt.Sprintf("hello%d", attempts))
+		if attempts == 4 {
+			//订阅成功后连接出错
+			reply += "-ERR connection lost\r\n"
+		}
+		return reply
+	})
+	defer srv.Close()
+	oldConf := ConfRedisMap
+	defer func() { ConfRedisMap = oldConf }()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{"pubsub_test": {ProxyList: []string{srv.Addr()}}}}
+
+	received := make(chan string, 10)
+	sub := NewRedisSubscriber("pubsub_test", []string{"ch"}, nil, func(trace *TraceContext, msg RedisMessage) {
+		if string(msg.Data) == "panic" {
+			panic("bad message")
+		}
+		received <- msg.Channel + ":" + string(msg.Data)
+	})
+	if err := sub.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if err := sub.Start(); err == nil {
+		t.Fatal("second Start should fail")
+	}
+
+	//handler的panic不影响后续消息
+	for _, expect := range []string{"ch:hello4", "ch:hello5"} {
+		select {
+		case msg := <-received:
+			if msg != expect {
+				t.Fatalf("received %s, want %s", msg, expect)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("message %s not received", expect)
+		}
+	}
+	//订阅成功后重新从最小退避时间开始重连
+	mu.Lock()
+	gap := subscribedAt[1].Sub(subscribedAt[0])
+	mu.Unlock()
+	if gap >= 400*time.Millisecond {
+		t.Fatalf("backoff not reset after a successful subscribe, reconnected after %s", gap)
+	}
+
+	if err := NewRedisSubscriber("pubsub_test", nil, nil, nil).Start(); err == nil {
+		t.Fatal("subscriber without channel should fail")
+	}
+}
+
+func TestRedisStreamConsumer(t *testing.T) {
+	var mu sync.Mutex
+	acked := []string{}
+	delivered := false
+	srv := newFakeRedisServer(t, func(conn *fakeRedisConn, args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "XGROUP":
+			return "-BUSYGROUP Consumer Group name already exists\r\n"
+		case "XPENDING":
+			return "*0\r\n"
+		case "XACK":
+			acked = append(acked, args[3])
+			return ":1\r\n"
+		case "XREADGROUP":
+			if args[len(args)-1] == "0" || delivered {
+				time.Sleep(5 * time.Millisecond)
+				return "*-1\r\n"
+			}
+			delivered = true
+			entry := func(id, v string) string {
+				return "*2\r\n" + fakeBulk(id) + fakeArray("v", v)
+			}
+			return "*1\r\n*2\r\n" + fakeBulk("s") + "*3\r\n" +
+				entry("1-0", "panic") + entry("2-0", "error") + entry("3-0", "ok")
+		}
+		return "-ERR unknown command\r\n"
+	})
+	defer srv.Close()
+	oldConf := ConfRedisMap
+	defer func() { ConfRedisMap = oldConf }()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{"stream_test": {ProxyList: []string{srv.Addr()}}}}
+
+	handled := make(chan string, 10)
+	consumer := NewRedisStreamConsumer("stream_test", "s", "g", "c1", RedisStreamOptions{Block: 10 * time.Millisecond},
+		func(trace *TraceContext, msg RedisStreamMessage) error {
+			handled <- msg.ID
+			switch msg.Values["v"] {
+			case "panic":
+				panic("bad message")
+			case "error":
+				return fmt.Errorf("retry later")
+			}
+			return nil
+		})
+	if err := consumer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"1-0", "2-0", "3-0"} {
+		select {
+		case id := <-handled:
+			if id != expect {
+				t.Fatalf("handled %s, want %s", id, expect)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("message %s not handled", expect)
+		}
+	}
+	//处理失败及panic的消息不ACK，留在pending中
+	ackedIDs := ""
+	for i := 0; i < 100 && ackedIDs == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		ackedIDs = strings.Join(acked, ",")
+		mu.Unlock()
+	}
+	consumer.Close()
+	if ackedIDs != "3-0" {
+		t.Fatalf("acked %s, want 3-0", ackedIDs)
+	}
+}
@@ -0,0 +1,131 @@
+package tool
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"time"
+)
+
+//sentinel模式：通过sentinel查询主节点地址，主从切换后重新查询
+type redisSentinel struct {
+	cfg        *RedisConf
+	mu         sync.RWMutex
+	masterAddr string //最近一次查询到的主节点地址
+}
+
+//记录了连接地址的连接，用于在主从切换后淘汰连接池中的旧连接
+type redisSentinelConn struct {
+	redis.Conn
+	addr string
+}
+
+//保留底层连接的超时能力，供redis.DoWithTimeout、ReceiveWithTimeout使用
+func (c *redisSentinelConn) DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	return redis.DoWithTimeout(c.Conn, timeout, commandName, args...)
+}
+
+func (c *redisSentinelConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return redis.ReceiveWithTimeout(c.Conn, timeout)
+}
+
+func newRedisSentinel(cfg *RedisConf) *redisSentinel {
+	return &redisSentinel{cfg: cfg}
+}
+
+//当前缓存的主节点地址
+func (s *redisSentinel) addr() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.masterAddr
+}
+
+//依次向sentinel查询主节点地址
+func (s *redisSentinel) resolve() (string, error) {
+	redisConfDefault(s.cfg)
+	lastErr := errors.New("redis sentinel_list is empty")
+	for _, sentinelAddr := range s.cfg.SentinelList {
+		c, err := redis.Dial("tcp", sentinelAddr,
+			redis.DialConnectTimeout(time.Duration(s.cfg.ConnTimeout)*time.Millisecond),
+			redis.DialReadTimeout(time.Duration(s.cfg.ReadTimeout)*time.Millisecond),
+			redis.DialWriteTimeout(time.Duration(s.cfg.WriteTimeout)*time.Millisecond),
+			redis.DialPassword(s.cfg.SentinelPassword))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		res, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.cfg.MasterName))
+		c.Close()
+		if err == redis.ErrNil {
+			err = errors.New("redis sentinel unknown master:" + s.cfg.MasterName)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(res) != 2 {
+			lastErr = errors.New("redis sentinel invalid master addr reply")
+			continue
+		}
+		addr := net.JoinHostPort(res[0], res[1])
+		s.mu.Lock()
+		s.masterAddr = addr
+		s.mu.Unlock()
+		return addr, nil
+	}
+	return "", lastErr
+}
+
+//连接主节点：缓存的地址不可用或已不是主节点时重新查询sentinel
+func (s *redisSentinel) dial() (redis.Conn, error) {
+	if addr := s.addr(); addr != "" {
+		c, err := redisDialAddr(s.cfg, addr)
+		if err == nil {
+			if redisIsMaster(c) {
+				return &redisSentinelConn{Conn: c, addr: addr}, nil
+			}
+			c.Close()
+		}
+	}
+	//主节点未知或已发生切换
+	addr, err := s.resolve()
+	if err != nil {
+		return nil, err
+	}
+	c, err := redisDialAddr(s.cfg, addr)
+	if err != nil {
+		return nil, err
+	}
+	if !redisIsMaster(c) {
+		c.Close()
+		return nil, errors.New("redis sentinel master is not master:" + addr)
+	}
+	return &redisSentinelConn{Conn: c, addr: addr}, nil
+}
+
+//生成连接池：地址已过期的连接直接淘汰，每次取出连接时检测ROLE，不受test_on_borrow影响
+//主从切换后取出的连接若已不是主节点，则淘汰该连接并重新查询sentinel，之后旧地址的连接全部被淘汰
+func (s *redisSentinel) newPool() *redis.Pool {
+	pool := newRedisPool(s.cfg, s.dial, nil)
+	pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+		if sc, ok := c.(*redisSentinelConn); ok && sc.addr != s.addr() {
+			return errors.New("redis sentinel master changed")
+		}
+		if !redisIsMaster(c) {
+			return errors.New("redis sentinel conn is not master")
+		}
+		return nil
+	}
+	return pool
+}
+
+//通过ROLE判断连接的节点是否为主节点
+func redisIsMaster(c redis.Conn) bool {
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil || len(role) == 0 {
+		return false
+	}
+	r, _ := redis.String(role[0], nil)
+	return r == "master"
+}
@@ -0,0 +1,150 @@
+package tool
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+//支持GET/SET/INCR和WATCH/MULTI/EXEC的简单服务，SET后其他连接WATCH的事务被中止
+func newFakeTxRedisServer(t *testing.T) *fakeRedisServer {
+	var mu sync.Mutex
+	values := map[string]string{}
+	dirty := map[*fakeRedisConn]bool{}
+	watching := map[*fakeRedisConn]bool{}
+	queued := map[*fakeRedisConn][][]string{}
+	var exec func(conn *fakeRedisConn, args []string) string
+	exec = func(conn *fakeRedisConn, args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			v, ok := values[args[1]]
+			if !ok {
+				return "$-1\r\n"
+			}
+			return fakeBulk(v)
+		case "SET":
+			values[args[1]] = args[2]
+			for c := range watching {
+				if c != conn {
+					dirty[c] = true
+				}
+			}
+			return "+OK\r\n"
+		case "INCR":
+			if values[args[1]] != "" && values[args[1]] != "1" {
+				return "-ERR value is not an integer or out of range\r\n"
+			}
+			values[args[1]] = "1"
+			return ":1\r\n"
+		}
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+	return newFakeRedisServer(t, func(conn *fakeRedisConn, args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "WATCH":
+			watching[conn] = true
+			return "+OK\r\n"
+		case "MULTI":
+			queued[conn] = [][]string{}
+			return "+OK\r\n"
+		case "EXEC":
+			cmds := queued[conn]
+			aborted := dirty[conn]
+			delete(queued, conn)
+			delete(watching, conn)
+			delete(dirty, conn)
+			if aborted {
+				return "*-1\r\n"
+			}
+			reply := fmt.Sprintf("*%d\r\n", len(cmds))
+			for _, cmd := range cmds {
+				reply += exec(conn, cmd)
+			}
+			return reply
+		}
+		if cmds, ok := queued[conn]; ok {
+			queued[conn] = append(cmds, args)
+			return "+QUEUED\r\n"
+		}
+		return exec(conn, args)
+	})
+}
+
+func TestRedisPipeline(t *testing.T) {
+	srv := newFakeTxRedisServer(t)
+	defer srv.Close()
+	oldConf := ConfRedisMap
+	defer func() { ConfRedisMap = oldConf }()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{"pipeline_test": {ProxyList: []string{srv.Addr()}}}}
+
+	results, err := RedisConfPipeline(NewTrace(), "pipeline_test", []RedisCmd{
+		{Name: "SET", Args: []interface{}{"k", "v"}},
+		{Name: "INCR", Args: []interface{}{"k"}},
+		{Name: "GET", Args: []interface{}{"k"}},
+	})
+	if err != nil || len(results) != 3 {
+		t.Fatalf("pipeline %v %v", results, err)
+	}
+	//单条命令失败不影响其他命令
+	if _, ok := results[1].Err.(redis.Error); !ok {
+		t.Fatalf("expected redis.Error for INCR, got %v", results[1].Err)
+	}
+	if v, err := redis.String(results[2].Reply, results[2].Err); err != nil || v != "v" {
+		t.Fatalf("GET reply %v %v", v, err)
+	}
+
+	if _, err := RedisConfPipeline(NewTrace(), "pipeline_missing", nil); err == nil {
+		t.Fatal("expected error for missing config")
+	}
+}
+
+func TestRedisTx(t *testing.T) {
+	srv := newFakeTxRedisServer(t)
+	defer srv.Close()
+	oldConf := ConfRedisMap
+	defer func() { ConfRedisMap = oldConf }()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{"tx_test": {ProxyList: []string{srv.Addr()}}}}
+
+	results, err := RedisConfTx(NewTrace(), "tx_test", []RedisCmd{
+		{Name: "SET", Args: []interface{}{"k", "v"}},
+		{Name: "INCR", Args: []interface{}{"k"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Reply != "OK" || results[0].Err != nil {
+		t.Fatalf("SET result %+v", results[0])
+	}
+	//执行阶段的错误记录在对应命令的结果中
+	if _, ok := results[1].Err.(redis.Error); !ok {
+		t.Fatalf("expected redis.Error for INCR, got %+v", results[1])
+	}
+
+	//WATCH的key被其他连接修改后EXEC返回nil，事务中止
+	c, err := RedisConnFactory("tx_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Do("WATCH", "k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RedisConfDo(NewTrace(), "tx_test", "SET", "k", "other"); err != nil {
+		t.Fatal(err)
+	}
+	results, err = RedisTx(NewTrace(), c, []RedisCmd{{Name: "SET", Args: []interface{}{"k", "mine"}}})
+	if err == nil || err.Error() != "redis transaction aborted" {
+		t.Fatalf("expected aborted transaction, got %v", err)
+	}
+	if results[0].Reply != nil {
+		t.Fatalf("aborted transaction should have no reply, got %+v", results[0])
+	}
+	if v, _ := redis.String(RedisConfDo(NewTrace(), "tx_test", "GET", "k")); v != "other" {
+		t.Fatalf("aborted transaction was applied, got %s", v)
+	}
+}